@@ -14,6 +14,18 @@ cd $GOPATH/src/github.com/vmware/go-pmem-transaction/txtest
 # in /home/travis/.gimme/versions/go1.11.1.linux.amd64 to do the build (TODO).
 GOROOT="$HOME/go-pmem/" GOTOOLDIR="$HOME/go-pmem/pkg/tool/linux_amd64" ~/go-pmem/bin/go test
 
+# In-package tests of the transaction package
+cd $GOPATH/src/github.com/vmware/go-pmem-transaction/transaction
+GOROOT="$HOME/go-pmem/" GOTOOLDIR="$HOME/go-pmem/pkg/tool/linux_amd64" ~/go-pmem/bin/go test
+
 cd $GOPATH/src/github.com/vmware/go-pmem-transaction/txtest/crashtest
 GOROOT="$HOME/go-pmem/" GOTOOLDIR="$HOME/go-pmem/pkg/tool/linux_amd64" ~/go-pmem/bin/go test -tags="crash"
 GOROOT="$HOME/go-pmem/" GOTOOLDIR="$HOME/go-pmem/pkg/tool/linux_amd64" ~/go-pmem/bin/go test -tags="crash"
+
+cd $GOPATH/src/github.com/vmware/go-pmem-transaction/txtest/atomicCrashTest
+GOROOT="$HOME/go-pmem/" GOTOOLDIR="$HOME/go-pmem/pkg/tool/linux_amd64" ~/go-pmem/bin/go test -tags="crash"
+GOROOT="$HOME/go-pmem/" GOTOOLDIR="$HOME/go-pmem/pkg/tool/linux_amd64" ~/go-pmem/bin/go test -tags="crash"
+
+cd $GOPATH/src/github.com/vmware/go-pmem-transaction/txtest/prepareCrashTest
+GOROOT="$HOME/go-pmem/" GOTOOLDIR="$HOME/go-pmem/pkg/tool/linux_amd64" ~/go-pmem/bin/go test -tags="crash"
+GOROOT="$HOME/go-pmem/" GOTOOLDIR="$HOME/go-pmem/pkg/tool/linux_amd64" ~/go-pmem/bin/go test -tags="crash"
@@ -23,17 +23,32 @@ type (
 		typ  []byte
 		ptr  unsafe.Pointer
 	}
+	// txHead records the log head of a kind of transaction
+	txHead struct {
+		kind []byte
+		ptr  unsafe.Pointer
+	}
 	pmemHeader struct {
-		// Transaction Log Header. We don't know what the app might use. So,
-		// initialize both undo & redo log
-		undoTxHeadPtr unsafe.Pointer
-		redoTxHeadPtr unsafe.Pointer
+		// Layout version of the header, set to headerVersion
+		version int
+
+		// Transaction Log Headers. We don't know what the app might use. So,
+		// initialize the logs of all registered kinds of transactions.
+		txHeads []txHead
 
 		// App-specific data structures, updated on named New, Make calls
 		// TODO: Use map, since this is a key-value pair, but Persistent maps
 		// are not supported yet.
 		appData []namedObject
 	}
+	// legacyHeader is the header of pools created before the version and the
+	// table of log heads were added. Its first word is the undo log head,
+	// which never matches headerVersion.
+	legacyHeader struct {
+		undoTxHeadPtr unsafe.Pointer
+		redoTxHeadPtr unsafe.Pointer
+		appData       []namedObject
+	}
 )
 
 var (
@@ -43,14 +58,96 @@ var (
 
 const (
 	sliceHeaderSize = 24 // size of a slice header
+	headerVersion   = 1  // transaction.SwizzleAndAbort() checks this too
 )
 
 func populateTxHeaderInRoot() {
-	rootPtr.undoTxHeadPtr = transaction.Init(rootPtr.undoTxHeadPtr, "undo")
-	rootPtr.redoTxHeadPtr = transaction.Init(rootPtr.redoTxHeadPtr, "redo")
+	for _, h := range rootPtr.txHeads {
+		if !transaction.Registered(string(h.kind)) {
+			log.Fatal("Transaction kind ", string(h.kind), " found in ",
+				"persistent memory is not registered")
+		}
+	}
+	for _, kind := range transaction.Kinds() {
+		if i := txHeadIndex(kind); i >= 0 {
+			ptr := transaction.Init(rootPtr.txHeads[i].ptr, kind)
+			if ptr != rootPtr.txHeads[i].ptr {
+				// The log was migrated from an older layout
+				setTxHead(i, ptr)
+			}
+		} else if ptr := transaction.Init(nil, kind); ptr != nil {
+			addTxHead(kind, ptr)
+		}
+	}
+}
+
+// txHeadIndex returns the index of the log head of kind in the root, or -1 if
+// the root has none.
+func txHeadIndex(kind string) int {
+	for i, h := range rootPtr.txHeads {
+		if string(h.kind) == kind {
+			return i
+		}
+	}
+	return -1
 }
 
-// Init returns true if this was a first time initialization.
+// setTxHead replaces the log head at index i in the root. The undo log must
+// already be initialized.
+func setTxHead(i int, ptr unsafe.Pointer) {
+	tx := transaction.NewUndoTx()
+	tx.Begin()
+	tx.Log3(unsafe.Pointer(&rootPtr.txHeads[i].ptr), unsafe.Sizeof(ptr))
+	rootPtr.txHeads[i].ptr = ptr
+	tx.End()
+	transaction.Release(tx)
+}
+
+// addTxHead adds the log head of a kind of transaction to the root. The undo
+// log must already be initialized.
+func addTxHead(kind string, ptr unsafe.Pointer) {
+	kindByte := pmake([]byte, len(kind))
+	copy(kindByte, kind)
+	runtime.PersistRange(unsafe.Pointer(&kindByte[0]), uintptr(len(kindByte)))
+	heads := pmake([]txHead, len(rootPtr.txHeads)+1)
+	copy(heads, rootPtr.txHeads)
+	heads[len(heads)-1] = txHead{kindByte, ptr}
+	runtime.PersistRange(unsafe.Pointer(&heads[0]),
+		uintptr(len(heads))*unsafe.Sizeof(heads[0]))
+	tx := transaction.NewUndoTx()
+	tx.Begin()
+	tx.Log3(unsafe.Pointer(&rootPtr.txHeads), sliceHeaderSize)
+	rootPtr.txHeads = heads
+	tx.End()
+	transaction.Release(tx)
+}
+
+// migrateHeader moves the undo and redo log heads of a pool created before the
+// header was versioned into the table of log heads. A new header is set as the
+// root, so a crash during migration leaves the legacy header in place.
+func migrateHeader(legacy *legacyHeader) *pmemHeader {
+	hdr := pnew(pmemHeader)
+	hdr.version = headerVersion
+	hdr.appData = legacy.appData
+	hdr.txHeads = pmake([]txHead, 2)
+	for i, kind := range []string{"undo", "redo"} {
+		kindByte := pmake([]byte, len(kind))
+		copy(kindByte, kind)
+		runtime.PersistRange(unsafe.Pointer(&kindByte[0]), uintptr(len(kindByte)))
+		hdr.txHeads[i].kind = kindByte
+	}
+	hdr.txHeads[0].ptr = legacy.undoTxHeadPtr
+	hdr.txHeads[1].ptr = legacy.redoTxHeadPtr
+	runtime.PersistRange(unsafe.Pointer(&hdr.txHeads[0]),
+		uintptr(len(hdr.txHeads))*unsafe.Sizeof(hdr.txHeads[0]))
+	runtime.PersistRange(unsafe.Pointer(hdr), unsafe.Sizeof(*hdr))
+	runtime.SetRoot(unsafe.Pointer(hdr))
+	return hdr
+}
+
+// Init returns true if this was a first time initialization. Redo transactions
+// found prepared for two-phase commit are left undecided, and their IDs are
+// returned by transaction.PreparedTxs().
 func Init(fileName string) bool {
 	// Register application callback function
 	// This function is called during heap recovery before pointers are swizzled
@@ -63,6 +160,7 @@ func Init(fileName string) bool {
 	var firstInit bool
 	if runtimeRootPtr == nil { // first time initialization
 		rootPtr = pnew(pmemHeader)
+		rootPtr.version = headerVersion
 		populateTxHeaderInRoot()
 		rootPtr.appData = pmake([]namedObject, 1) // Start with size of 1
 		runtime.PersistRange(unsafe.Pointer(rootPtr),
@@ -71,6 +169,9 @@ func Init(fileName string) bool {
 		firstInit = true
 	} else {
 		rootPtr = (*pmemHeader)(runtimeRootPtr)
+		if rootPtr.version != headerVersion {
+			rootPtr = migrateHeader((*legacyHeader)(runtimeRootPtr))
+		}
 		populateTxHeaderInRoot()
 	}
 	m = new(sync.RWMutex)
@@ -0,0 +1,116 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Failure-atomic operations on a single 8-byte aligned word, which need no
+ * transaction handle. The new value of the word is written using a
+ * non-temporal store followed by a fence. A non-temporal store becomes visible
+ * to other cores only once it reaches the memory controller, which is in the
+ * persistence domain. So no goroutine can observe a value that may be lost on
+ * a crash, and the operations are durably linearizable. Each operation returns
+ * only after its update is persistent.
+ *
+ * Operations on the same word are serialized through a table of locks, so that
+ * the read-modify-write operations are atomic. The words can be read
+ * concurrently using sync/atomic loads. Words updated using these functions must
+ * not be updated in any other way.
+ * E.g.:
+ *     transaction.AtomicAdd64(&S.counter, 1)
+ *     if transaction.AtomicCAS64(&S.state, idle, busy) {
+ *         ...
+ *     }
+ */
+
+package transaction
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Number of locks serializing the atomic operations
+const atomicStripes = 1024
+
+// atomicStripe occupies a whole cacheline, so that adjacent locks do not share
+// a cacheline.
+type atomicStripe struct {
+	sync.Mutex
+	// The source of the non-temporal store. Kept here rather than on the stack,
+	// as the stack may be moved.
+	buf uint64
+	// Pointers overwritten and stored by AtomicStorePointer are written here
+	// using regular stores, so that the GC write barrier sees them.
+	pin unsafe.Pointer
+	_   [cacheSize - 16 - unsafe.Sizeof(sync.Mutex{})]byte
+}
+
+var atomicLocks [atomicStripes]atomicStripe
+
+// lockWord locks the stripe covering the word at addr and returns it. It panics
+// if addr is not 8-byte aligned.
+func lockWord(addr unsafe.Pointer) *atomicStripe {
+	a := uintptr(addr)
+	if a&7 != 0 {
+		log.Panic("[atomic] Address must be 8-byte aligned")
+	}
+	s := &atomicLocks[(a>>3)%atomicStripes]
+	s.Lock()
+	return s
+}
+
+// storeWord durably stores s.buf at addr. The stripe covering addr must be
+// locked.
+func (s *atomicStripe) storeWord(addr unsafe.Pointer) {
+	movnt1x8b(uintptr(addr), uintptr(unsafe.Pointer(&s.buf)))
+	runtime.Fence()
+}
+
+// AtomicStore64 durably stores val at addr.
+func AtomicStore64(addr *uint64, val uint64) {
+	s := lockWord(unsafe.Pointer(addr))
+	s.buf = val
+	s.storeWord(unsafe.Pointer(addr))
+	s.Unlock()
+}
+
+// AtomicAdd64 durably adds delta to the word at addr and returns the new value.
+func AtomicAdd64(addr *uint64, delta uint64) (new uint64) {
+	s := lockWord(unsafe.Pointer(addr))
+	new = atomic.LoadUint64(addr) + delta
+	s.buf = new
+	s.storeWord(unsafe.Pointer(addr))
+	s.Unlock()
+	return new
+}
+
+// AtomicCAS64 durably stores new at addr if the word at addr holds old. It
+// returns true if the word was updated.
+func AtomicCAS64(addr *uint64, old, new uint64) bool {
+	s := lockWord(unsafe.Pointer(addr))
+	defer s.Unlock()
+	if atomic.LoadUint64(addr) != old {
+		return false
+	}
+	s.buf = new
+	s.storeWord(unsafe.Pointer(addr))
+	return true
+}
+
+// AtomicStorePointer durably stores val at addr. val should point to persistent
+// memory if addr is in persistent memory.
+func AtomicStorePointer(addr *unsafe.Pointer, val unsafe.Pointer) {
+	s := lockWord(unsafe.Pointer(addr))
+	// Non-temporal stores bypass the GC write barrier. So both the pointer being
+	// overwritten and the new pointer are passed through the write barrier by
+	// storing them in the stripe.
+	s.pin = atomic.LoadPointer(addr)
+	s.pin = val
+	s.buf = uint64(uintptr(val))
+	s.storeWord(unsafe.Pointer(addr))
+	s.pin = nil
+	s.Unlock()
+}
@@ -2,58 +2,320 @@ package transaction
 
 import (
 	"log"
+	"math/bits"
 	"runtime"
+	"sync"
 	"sync/atomic"
-	"unsafe"
+	"time"
 )
 
 const (
 	bitsPerByte = 8
+	bitsPerWord = 64
 )
 
+// Each word of the bitmap holds up to 64 bits and is padded to occupy a whole
+// cacheline, so that goroutines using different words do not contend on the
+// same cacheline. Each word acts as a shard of the bitmap.
+type bitmapWord struct {
+	bits uint64
+	_    [cacheSize - 8]byte
+}
+
 type bitmap struct {
-	bitArray []uint32
-	// cachedIndex is a hint as to where to begin the next search for an unset bit
-	cachedIndex int
+	// words holds pointers to the words of the bitmap. A word is never moved
+	// once allocated. When the bitmap grows, a new list of words is stored, so
+	// that concurrent readers see either list.
+	words atomic.Value // []*bitmapWord
+	// Number of bits added to the bitmap at a time
+	chunkLen int
+	// Each chunk of bits is split across wordsPerChunk words, each holding
+	// wordLen bits. The last word of a chunk may hold fewer bits.
+	wordsPerChunk int
+	wordLen       int
+
+	// Index of the word where a goroutine begins its search for an unset bit.
+	// As sync.Pool keeps a cache for each P, goroutines running on different
+	// Ps mostly get different hints.
+	hints sync.Pool
+	// The word given to the next hint created
+	nextHint uint32
+
+	// Goroutines which find all bits set are parked on a channel in waitq, in
+	// FIFO order, until a bit is cleared.
+	mu    sync.Mutex
+	waitq []chan struct{}
+	// Number of goroutines waiting for a bit to be cleared
+	waiters int64
+
+	// grow is called when all bits are set, to allocate the resources
+	// associated with a new chunk of bits. It returns false if the bitmap
+	// cannot grow. growMu serializes the calls to grow.
+	grow   func() bool
+	growMu sync.Mutex
 }
 
 // Create a new bitmap datastructure with space allocated for the backing array.
+// There are at least as many words as Ps, up to one word per bit, so that
+// goroutines running on different Ps can claim bits from different words.
 func newBitmap(length int) *bitmap {
-	bitArray := make([]uint32, length)
-	return &bitmap{bitArray, 0}
+	bm := &bitmap{chunkLen: length}
+	n := (length + bitsPerWord - 1) / bitsPerWord
+	if procs := runtime.GOMAXPROCS(0); n < procs {
+		n = procs
+	}
+	if n > length {
+		n = length
+	}
+	bm.wordLen = (length + n - 1) / n
+	bm.wordsPerChunk = (length + bm.wordLen - 1) / bm.wordLen
+	bm.hints.New = func() interface{} {
+		w := int(atomic.AddUint32(&bm.nextHint, 1) - 1)
+		return &w
+	}
+	bm.words.Store([]*bitmapWord(nil))
+	bm.addChunk()
+	return bm
 }
 
-// changeBit atomically tries to change the bit at index 'b' from old to new. It
-// returns true if this was successful, and false in all other cases.
-func (bm *bitmap) changeBit(b int, old, new uint32) bool {
-	bitAddr := (*uint32)(unsafe.Pointer(&bm.bitArray[b]))
-	return atomic.CompareAndSwapUint32(bitAddr, old, new)
+// addChunk adds chunkLen unset bits to the bitmap. Calls to addChunk must be
+// serialized by the caller.
+func (bm *bitmap) addChunk() {
+	old := bm.words.Load().([]*bitmapWord)
+	n := bm.wordsPerChunk
+	chunk := make([]bitmapWord, n)
+	for i := range chunk {
+		// The bits beyond wordLen in each word, and beyond chunkLen in the
+		// last word, are never unset
+		chunk[i].bits = ^uint64(0) << uint(bm.wordLen)
+	}
+	if rem := bm.chunkLen % bm.wordLen; rem != 0 {
+		chunk[n-1].bits = ^uint64(0) << uint(rem)
+	}
+	words := make([]*bitmapWord, len(old), len(old)+n)
+	copy(words, old)
+	for i := range chunk {
+		words = append(words, &chunk[i])
+	}
+	bm.words.Store(words)
+	bm.wakeAll()
 }
 
-// Returns the next index in the bitmap that is unset.
-func (bm *bitmap) nextAvailable() int {
-	ciAddr := (*int64)(unsafe.Pointer(&bm.cachedIndex))
+// bitIndex returns the index of bit 'b' of word 'w'.
+func (bm *bitmap) bitIndex(w, b int) int {
+	return w/bm.wordsPerChunk*bm.chunkLen + w%bm.wordsPerChunk*bm.wordLen + b
+}
+
+// wordBit returns the word holding the bit at index 'b', and its mask.
+func (bm *bitmap) wordBit(b int) (*bitmapWord, uint64) {
+	words := bm.words.Load().([]*bitmapWord)
+	c, i := b/bm.chunkLen, b%bm.chunkLen
+	return words[c*bm.wordsPerChunk+i/bm.wordLen],
+		uint64(1) << uint(i%bm.wordLen)
+}
+
+// claimBit sets an unset bit and returns its index. The search begins at the
+// word given by the hint of the calling goroutine, and steals a bit from the
+// other words if all bits in that word are set. The hint is then set to the
+// word where a bit was found. It returns -1 if all bits are set.
+func (bm *bitmap) claimBit() int {
+	words := bm.words.Load().([]*bitmapWord)
+	n := len(words)
+	hint := bm.hints.Get().(*int)
+	defer bm.hints.Put(hint)
+	home := *hint % n
+	for i := 0; i < n; i++ {
+		w := home + i
+		if w >= n {
+			w -= n
+		}
+		word := words[w]
+		for {
+			old := atomic.LoadUint64(&word.bits)
+			if old == ^uint64(0) {
+				break
+			}
+			b := bits.TrailingZeros64(^old)
+			if atomic.CompareAndSwapUint64(&word.bits, old, old|1<<uint(b)) {
+				*hint = w
+				return bm.bitIndex(w, b)
+			}
+		}
+	}
+	return -1
+}
+
+// hasUnset returns true if any bit in the bitmap is unset.
+func (bm *bitmap) hasUnset() bool {
+	for _, word := range bm.words.Load().([]*bitmapWord) {
+		if atomic.LoadUint64(&word.bits) != ^uint64(0) {
+			return true
+		}
+	}
+	return false
+}
+
+// wake unparks the goroutine which has waited the longest for a bit to be
+// cleared.
+func (bm *bitmap) wake() {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if len(bm.waitq) > 0 {
+		close(bm.waitq[0])
+		bm.waitq[0] = nil
+		bm.waitq = bm.waitq[1:]
+	}
+}
+
+// wakeAll unparks all goroutines waiting for a bit to be cleared.
+func (bm *bitmap) wakeAll() {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	for i, ch := range bm.waitq {
+		close(ch)
+		bm.waitq[i] = nil
+	}
+	bm.waitq = bm.waitq[:0]
+}
+
+// dequeue removes 'ch' from waitq. If 'ch' was already removed, the goroutine
+// was woken up while it was not waiting, so the next waiter is woken instead.
+func (bm *bitmap) dequeue(ch chan struct{}) {
+	bm.mu.Lock()
+	for i, c := range bm.waitq {
+		if c == ch {
+			bm.waitq = append(bm.waitq[:i], bm.waitq[i+1:]...)
+			bm.mu.Unlock()
+			return
+		}
+	}
+	bm.mu.Unlock()
+	bm.wake()
+}
 
+// waitForBit parks the calling goroutine until a bit is cleared, and then sets
+// it and returns its index. If timeout is not negative, it gives up after
+// 'timeout' has elapsed and returns -1.
+func (bm *bitmap) waitForBit(timeout time.Duration) int {
+	var timerC <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timerC = timer.C
+	}
+	atomic.AddInt64(&bm.waiters, 1)
+	defer atomic.AddInt64(&bm.waiters, -1)
 	for {
-		ind := int(atomic.LoadInt64(ciAddr))
-		ln := len(bm.bitArray)
-		for i := 0; i < ln; i++ {
-			b := (ind + i) % ln
-			if bm.changeBit(b, 0, 1) {
+		ch := make(chan struct{})
+		bm.mu.Lock()
+		bm.waitq = append(bm.waitq, ch)
+		bm.mu.Unlock()
+		// A bit may have been cleared before this goroutine was queued
+		if b := bm.claimBit(); b >= 0 {
+			bm.dequeue(ch)
+			return b
+		}
+		select {
+		case <-ch:
+			// Another goroutine may set the bit which was cleared before
+			// this goroutine does. If so, wait again.
+			if b := bm.claimBit(); b >= 0 {
 				return b
 			}
+		case <-timerC:
+			bm.dequeue(ch)
+			return bm.claimBit()
+		}
+	}
+}
+
+// tryGrow grows the bitmap if all bits are set. It returns true if unset bits
+// may be available.
+func (bm *bitmap) tryGrow() bool {
+	if bm.grow == nil {
+		return false
+	}
+	bm.growMu.Lock()
+	defer bm.growMu.Unlock()
+	if bm.hasUnset() {
+		// Some other goroutine grew the bitmap or cleared a bit meanwhile
+		return true
+	}
+	if !bm.grow() {
+		return false
+	}
+	bm.addChunk()
+	return true
+}
+
+// Returns the next index in the bitmap that is unset. If all bits are set and
+// the bitmap cannot grow, the calling goroutine is parked until a bit is
+// cleared.
+func (bm *bitmap) nextAvailable() int {
+	if b := bm.tryNextAvailable(); b >= 0 {
+		return b
+	}
+	return bm.waitForBit(-1)
+}
+
+// tryNextAvailable returns the next index in the bitmap that is unset. It
+// returns -1 if all bits are set and the bitmap cannot grow.
+func (bm *bitmap) tryNextAvailable() int {
+	for {
+		if b := bm.claimBit(); b >= 0 {
+			return b
+		}
+		if !bm.tryGrow() {
+			return -1
 		}
-		// No unset bit at this time. Let some other goroutine (if available)
-		// run instead.
-		runtime.Gosched()
 	}
 }
 
-// clearBit clears the bit at index 'b''
+// nextAvailableTimeout returns the next index in the bitmap that is unset. If
+// all bits are set and the bitmap cannot grow, the calling goroutine is parked
+// until a bit is cleared or until 'timeout' has elapsed. It returns -1 on
+// timeout.
+func (bm *bitmap) nextAvailableTimeout(timeout time.Duration) int {
+	if b := bm.tryNextAvailable(); b >= 0 {
+		return b
+	}
+	return bm.waitForBit(timeout)
+}
+
+// numWaiters returns the number of goroutines waiting for a bit to be cleared.
+func (bm *bitmap) numWaiters() int {
+	return int(atomic.LoadInt64(&bm.waiters))
+}
+
+// clearBit clears the bit at index 'b' and wakes up a goroutine waiting for a
+// bit to be cleared, if any.
 func (bm *bitmap) clearBit(b int) {
-	if !bm.changeBit(b, 1, 0) {
-		log.Fatal("Bit already unset")
+	word, mask := bm.wordBit(b)
+	for {
+		old := atomic.LoadUint64(&word.bits)
+		if old&mask == 0 {
+			log.Fatal("Bit already unset")
+		}
+		if atomic.CompareAndSwapUint64(&word.bits, old, old&^mask) {
+			break
+		}
+	}
+	if atomic.LoadInt64(&bm.waiters) > 0 {
+		bm.wake()
+	}
+}
+
+// setBit sets the bit at index 'b', which must be unset. This is used to mark
+// a handle as in use when it is not claimed through claimBit.
+func (bm *bitmap) setBit(b int) {
+	word, mask := bm.wordBit(b)
+	for {
+		old := atomic.LoadUint64(&word.bits)
+		if old&mask != 0 {
+			log.Fatal("Bit already set")
+		}
+		if atomic.CompareAndSwapUint64(&word.bits, old, old|mask) {
+			return
+		}
 	}
-	ciAddr := (*int64)(unsafe.Pointer(&bm.cachedIndex))
-	atomic.StoreInt64(ciAddr, int64(b))
 }
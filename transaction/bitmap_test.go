@@ -0,0 +1,167 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package transaction
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+// slotBitmap is the earlier handle allocator, which stores one uint32 per slot
+// and begins every search from a single shared cachedIndex. It is kept here
+// to compare the performance of bitmap against it.
+type slotBitmap struct {
+	bitArray    []uint32
+	cachedIndex int
+}
+
+func newSlotBitmap(length int) *slotBitmap {
+	return &slotBitmap{make([]uint32, length), 0}
+}
+
+func (bm *slotBitmap) changeBit(b int, old, new uint32) bool {
+	bitAddr := (*uint32)(unsafe.Pointer(&bm.bitArray[b]))
+	return atomic.CompareAndSwapUint32(bitAddr, old, new)
+}
+
+func (bm *slotBitmap) nextAvailable() int {
+	ciAddr := (*int64)(unsafe.Pointer(&bm.cachedIndex))
+	for {
+		ind := int(atomic.LoadInt64(ciAddr))
+		ln := len(bm.bitArray)
+		for i := 0; i < ln; i++ {
+			b := (ind + i) % ln
+			if bm.changeBit(b, 0, 1) {
+				return b
+			}
+		}
+		runtime.Gosched()
+	}
+}
+
+func (bm *slotBitmap) clearBit(b int) {
+	if !bm.changeBit(b, 1, 0) {
+		panic("Bit already unset")
+	}
+	ciAddr := (*int64)(unsafe.Pointer(&bm.cachedIndex))
+	atomic.StoreInt64(ciAddr, int64(b))
+}
+
+type allocator interface {
+	nextAvailable() int
+	clearBit(b int)
+}
+
+// runAlloc acquires and releases a bit b.N times in total, split across
+// 'goroutines' goroutines.
+func runAlloc(b *testing.B, bm allocator, goroutines int) {
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		n := b.N / goroutines
+		if g < b.N%goroutines {
+			n++
+		}
+		go func(n int) {
+			for i := 0; i < n; i++ {
+				bm.clearBit(bm.nextAvailable())
+			}
+			wg.Done()
+		}(n)
+	}
+	wg.Wait()
+}
+
+func BenchmarkHandleAlloc(b *testing.B) {
+	for _, goroutines := range []int{1, 8, 64, 512} {
+		b.Run(fmt.Sprintf("bitmap/goroutines-%d", goroutines),
+			func(b *testing.B) {
+				runAlloc(b, newBitmap(logNum), goroutines)
+			})
+		b.Run(fmt.Sprintf("slotBitmap/goroutines-%d", goroutines),
+			func(b *testing.B) {
+				runAlloc(b, newSlotBitmap(logNum), goroutines)
+			})
+	}
+}
+
+func TestBitmapConcurrent(t *testing.T) {
+	const goroutines = 64
+	bm := newBitmap(logNum)
+	var inUse [logNum]int32
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				b := bm.nextAvailable()
+				if !atomic.CompareAndSwapInt32(&inUse[b], 0, 1) {
+					t.Errorf("Bit %d handed out twice", b)
+					return
+				}
+				atomic.StoreInt32(&inUse[b], 0)
+				bm.clearBit(b)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Set all bits, then check that a waiting goroutine gets a cleared bit
+	for i := 0; i < logNum; i++ {
+		bm.nextAvailable()
+	}
+	if bm.tryNextAvailable() != -1 {
+		t.Fatal("Bit set when all bits were already set")
+	}
+	got := make(chan int)
+	go func() {
+		got <- bm.nextAvailable()
+	}()
+	for bm.numWaiters() != 1 {
+		runtime.Gosched()
+	}
+	bm.clearBit(100)
+	if b := <-got; b != 100 {
+		t.Fatalf("Waiting goroutine got bit %d instead of 100", b)
+	}
+}
+
+func TestBitmapShards(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(32))
+	bm := newBitmap(logNum)
+	if n := len(bm.words.Load().([]*bitmapWord)); n < 32 {
+		t.Fatalf("want at least 32 words, got = %d", n)
+	}
+	grown := false
+	bm.grow = func() bool {
+		if grown {
+			return false
+		}
+		grown = true
+		return true
+	}
+	seen := make([]bool, 2*logNum)
+	for i := 0; i < 2*logNum; i++ {
+		b := bm.tryNextAvailable()
+		if b < 0 || b >= 2*logNum || seen[b] {
+			t.Fatalf("Bit %d handed out after %d bits", b, i)
+		}
+		seen[b] = true
+	}
+	if b := bm.tryNextAvailable(); b != -1 {
+		t.Fatalf("Bit %d set when all bits were already set", b)
+	}
+	bm.clearBit(logNum + 100)
+	if b := bm.tryNextAvailable(); b != logNum+100 {
+		t.Fatalf("Got bit %d instead of %d", b, logNum+100)
+	}
+}
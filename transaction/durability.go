@@ -0,0 +1,197 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Durability levels of transactions. The durability of a transaction is chosen
+ * when the outermost transaction begins, e.g. tx.Begin("deferred").
+ *
+ * "sync" is the default. When End() returns, all updates of the transaction
+ * are durable.
+ *
+ * "deferred" is supported by redo transactions. End() returns once the redo log
+ * is persisted and the transaction is marked committed, so the updates survive
+ * a crash from then on. The updates are copied to the program variables by a
+ * background applier goroutine. The locks held by the transaction are released
+ * only after this is done. Until then, ReadLog() reads the updates through from
+ * the redo log of the transaction. Releasing the handle, or beginning another
+ * transaction with it, waits for the updates to be applied.
+ *
+ * "none" gives volatile-only semantics. Such a transaction can only update data
+ * in volatile memory, and nothing is persisted in the log. The updates can still
+ * be reverted if the transaction aborts at runtime. Logging data in persistent
+ * memory returns ErrVolatileOnly, as nothing would be persisted to revert or
+ * complete a partial update of it after a crash.
+ *
+ * The durability of a redo transaction is stored in its log, so that recovery
+ * applies the updates of committed "sync" and "deferred" transactions, and
+ * never those of "none" transactions.
+ */
+
+package transaction
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrVolatileOnly is returned when a transaction with durability "none" is used
+// to update data in persistent memory.
+var ErrVolatileOnly = errors.New("Transactions with durability none can only " +
+	"update data in volatile memory")
+
+// Durability is the durability level of a transaction
+type Durability string
+
+const (
+	DurabilitySync     Durability = "sync"
+	DurabilityDeferred Durability = "deferred"
+	DurabilityNone     Durability = "none"
+)
+
+// Durability levels as stored in the redo log. The zero value is sync, so logs
+// written before durability levels were recorded are handled as before.
+const (
+	durSync = iota
+	durDeferred
+	durNone
+)
+
+var (
+	// Redo transactions ending with deferred durability whose updates have not
+	// been applied yet, in the order in which they ended. The updates are
+	// applied by a single goroutine in this order.
+	deferredMu  sync.RWMutex
+	deferredTxs []*redoTx
+	// Number of transactions in deferredTxs. Accessed atomically.
+	numDeferred int64
+	deferredQ   chan *redoTx
+	applierOnce sync.Once
+)
+
+// durabilityCode returns the code of the durability level given to Begin(), or
+// an error if more than one level or an unknown level is given.
+func durabilityCode(d []Durability) (int, error) {
+	if len(d) == 0 {
+		return durSync, nil
+	}
+	if len(d) > 1 {
+		return durSync, errors.New("Begin: Only one durability level can be " +
+			"given")
+	}
+	switch d[0] {
+	case DurabilitySync:
+		return durSync, nil
+	case DurabilityDeferred:
+		return durDeferred, nil
+	case DurabilityNone:
+		return durNone, nil
+	}
+	return durSync, errors.New("Begin: Unknown durability level " + string(d[0]) +
+		". Try sync/deferred/none")
+}
+
+// deferApply queues a committed redo transaction to have its updates applied by
+// the background applier. ReadLog() reads its updates through from its log
+// until then.
+func deferApply(t *redoTx) {
+	applierOnce.Do(func() {
+		deferredQ = make(chan *redoTx, logNum)
+		go applier()
+	})
+	t.applied = make(chan struct{})
+	deferredMu.Lock()
+	deferredTxs = append(deferredTxs, t)
+	atomic.AddInt64(&numDeferred, 1)
+	deferredMu.Unlock()
+	deferredQ <- t
+}
+
+// applier applies the updates of deferred transactions in the order in which
+// they ended. Once the updates are durable, the transaction stops being read
+// through, and its log is reset, which also releases its locks.
+func applier() {
+	for t := range deferredQ {
+		t.applyLog(false)
+		deferredMu.Lock()
+		for i, dt := range deferredTxs {
+			if dt == t {
+				copy(deferredTxs[i:], deferredTxs[i+1:])
+				deferredTxs[len(deferredTxs)-1] = nil
+				deferredTxs = deferredTxs[:len(deferredTxs)-1]
+				break
+			}
+		}
+		atomic.AddInt64(&numDeferred, -1)
+		deferredMu.Unlock()
+		applied := t.applied
+		t.endCommit()
+		close(applied)
+	}
+}
+
+// waitApplied waits until the updates of the last transaction of t are applied,
+// if it ended with deferred durability.
+func (t *redoTx) waitApplied() {
+	if t.applied != nil {
+		<-t.applied
+		t.applied = nil
+	}
+}
+
+// readThrough returns the value of type 'typ' at 'ptr' as updated by the latest
+// deferred transaction whose updates have not been applied yet. It returns
+// false if no such transaction updated the data.
+func readThrough(ptr uintptr, typ reflect.Type) (reflect.Value, bool) {
+	if atomic.LoadInt64(&numDeferred) == 0 {
+		return reflect.Value{}, false
+	}
+	deferredMu.RLock()
+	defer deferredMu.RUnlock()
+	for i := len(deferredTxs) - 1; i >= 0; i-- {
+		t := deferredTxs[i]
+		if t.overlaps(ptr, typ.Size()) {
+			// Copy the value, as the log may be reused once the updates
+			// are applied
+			v := reflect.New(typ).Elem()
+			v.Set(t.readLogValue(ptr, typ, nil))
+			return v, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// readThroughPtr returns the latest value of the data pointed to by ptrV,
+// reading it through from the deferred transactions if needed.
+func readThroughPtr(ptrV reflect.Value) interface{} {
+	if v, ok := readThrough(ptrV.Pointer(), ptrV.Type().Elem()); ok {
+		return v.Interface()
+	}
+	return reflect.Indirect(ptrV).Interface()
+}
+
+// overlaps returns true if any update in the log of t overlaps with the 'size'
+// bytes starting at 'ptr'.
+func (t *redoTx) overlaps(ptr, size uintptr) bool {
+	for i := 0; i < t.tail; i++ {
+		start := uintptr(t.log[i].ptr)
+		if ptr < start+uintptr(t.log[i].size) && start < ptr+size {
+			return true
+		}
+	}
+	return false
+}
+
+// applyVolatile copies the data in the log to the app data structures without
+// flushing it, for transactions with no durability. Such transactions only log
+// data in volatile memory.
+func (t *redoTx) applyVolatile() {
+	for i := 0; i < t.tail; i++ {
+		size := uintptr(t.log[i].size)
+		dst := (*[maxInt]byte)(t.log[i].ptr)[:size:size]
+		src := (*[maxInt]byte)(t.log[i].data)[:size:size]
+		copy(dst, src)
+	}
+}
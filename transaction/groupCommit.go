@@ -0,0 +1,145 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Group commit. When enabled, transactions ending within a short window of each
+ * other are made durable together. The first transaction to end becomes the
+ * leader of a group. It waits for the window to elapse, or for the group to
+ * fill up, and then commits every transaction in the group. The data of all
+ * transactions in the group is flushed, each cacheline only once, followed by
+ * a single fence. Then the commit record of each transaction is written,
+ * flushed and fenced once in the same way. Each transaction returns from End()
+ * only after its commit record is persistent.
+ *
+ * The commit record of an undo transaction is its generation number, and that
+ * of a redo transaction is its committed flag. Flushes are issued by the leader
+ * for all transactions in the group, as a fence only orders the flushes issued
+ * by the goroutine calling it. For the same reason, a transaction which made
+ * non-temporal stores not yet fenced fences them itself before joining a group.
+ */
+
+package transaction
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Maximum number of transactions committed together
+const groupCommitMax = 64
+
+type commitReq struct {
+	// Cachelines to be made durable before the commit record
+	fs *flushSt
+	// Writes the commit record and returns the range it occupies
+	mark func() (unsafe.Pointer, uintptr)
+	done chan struct{}
+}
+
+var (
+	// Group commit window in nanoseconds. Zero disables group commit.
+	// Accessed atomically.
+	groupWindow int64
+
+	gcMu sync.Mutex
+	// Transactions waiting to be committed by the leader of the group
+	gcPending []*commitReq
+	// gcLeader is true if a group has a leader
+	gcLeader bool
+	// Signalled when the group is full
+	gcFull = make(chan struct{}, 1)
+)
+
+// SetGroupCommit enables group commit for both undo and redo transactions.
+// Transactions ending within 'window' of the first transaction in a group are
+// made durable together, using one flush and fence for the whole group. This
+// reduces the number of fences when many small transactions end concurrently,
+// but each transaction may wait for up to 'window' in End(). A window of zero,
+// which is the default, disables group commit.
+func SetGroupCommit(window time.Duration) {
+	atomic.StoreInt64(&groupWindow, int64(window))
+}
+
+// groupCommitWindow returns the group commit window, and false if group commit
+// is disabled.
+func groupCommitWindow() (time.Duration, bool) {
+	window := time.Duration(atomic.LoadInt64(&groupWindow))
+	return window, window > 0
+}
+
+// groupCommit makes the cachelines tracked in fs durable, and then writes the
+// commit record using mark and makes it durable, together with the other
+// transactions ending within 'window'. ntStores is true if the transaction made
+// non-temporal stores which are not yet fenced. fs is cleared before it returns.
+func groupCommit(fs *flushSt, mark func() (unsafe.Pointer, uintptr),
+	window time.Duration, ntStores bool) {
+	if ntStores {
+		// Non-temporal stores made by this goroutine, such as log entries
+		// and data written using movnt, are only ordered by a fence issued
+		// on the same core. The leader's fence does not order them, so they
+		// are fenced here, before the leader can write the commit record.
+		fence()
+	}
+	req := &commitReq{fs: fs, mark: mark, done: make(chan struct{})}
+	gcMu.Lock()
+	gcPending = append(gcPending, req)
+	if gcLeader {
+		if len(gcPending) >= groupCommitMax {
+			select {
+			case gcFull <- struct{}{}:
+			default:
+			}
+		}
+		gcMu.Unlock()
+		<-req.done
+		return
+	}
+	gcLeader = true
+	// Drop a signal left over from an earlier group
+	select {
+	case <-gcFull:
+	default:
+	}
+	gcMu.Unlock()
+
+	timer := time.NewTimer(window)
+	select {
+	case <-timer.C:
+	case <-gcFull:
+		timer.Stop()
+	}
+
+	gcMu.Lock()
+	group := gcPending
+	gcPending = nil
+	gcLeader = false
+	gcMu.Unlock()
+	commitGroup(group)
+}
+
+// commitGroup makes the transactions in 'group' durable, using one flush and
+// fence for their data, and one for their commit records.
+func commitGroup(group []*commitReq) {
+	var data, records flushSt
+	data.data = make(map[unsafe.Pointer]uintptr)
+	for _, r := range group {
+		for k, v := range r.fs.data {
+			data.data[k] |= v
+		}
+	}
+	data.flushAndFence()
+	for _, r := range group {
+		ptr, size := r.mark()
+		records.insert(uintptr(ptr), size)
+	}
+	records.flushAndFence()
+	for _, r := range group {
+		for k := range r.fs.data {
+			delete(r.fs.data, k)
+		}
+		close(r.done)
+	}
+}
@@ -0,0 +1,302 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package transaction
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// ErrDeadlock is returned when a lock could not be acquired by a transaction
+// within the lock timeout, or when upgrading a read lock to a write lock failed
+// because another transaction acquired the write lock in between. The
+// transaction is aborted before this is returned.
+var ErrDeadlock = errors.New("Lock not acquired within timeout. Possible " +
+	"deadlock, transaction aborted")
+
+// Time for which a transaction waits to acquire a lock, in nanoseconds. Zero
+// means transactions wait forever, unless range locking is enabled. Accessed
+// atomically.
+var lockTimeout int64
+
+// The lock timeout used while range locking is enabled, if none is set.
+// Transactions acquire range locks in the order they log data, so they may
+// deadlock even if the application orders its own locks.
+const defaultRangeLockTimeout = time.Second
+
+// SetLockTimeout sets the time for which transactions wait to acquire a lock
+// through RLock(), WLock(), Lock() or LockAll(). If a lock is not acquired in
+// this time, the transaction is assumed to be part of a deadlock. It is then
+// aborted, releasing all its locks, and ErrDeadlock is returned. A timeout of
+// zero, which is the default, disables deadlock detection, unless range locking
+// is enabled, in which case a timeout of one second is used.
+func SetLockTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&lockTimeout, int64(timeout))
+}
+
+// lockIndex returns the index of m in locks, or -1 if m is not present.
+func lockIndex(locks []*sync.RWMutex, m *sync.RWMutex) int {
+	for i, l := range locks {
+		if l == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// Number of write generation counters of mutexes outside the range lock table
+const lockGenStripes = 1024
+
+// Write generation counters. The counter at index i is incremented whenever a
+// transaction acquires the write lock on a mutex whose address hashes to i.
+// Locks in the range lock table have their own counters. Accessed atomically.
+var lockGens [lockGenStripes]uint64
+
+// lockGen returns the write generation counter of m.
+func lockGen(m *sync.RWMutex) *uint64 {
+	addr := uintptr(unsafe.Pointer(m))
+	first := uintptr(unsafe.Pointer(&rangeLocks[0]))
+	if addr >= first && addr < first+unsafe.Sizeof(rangeLocks) {
+		return &rangeLocks[(addr-first)/unsafe.Sizeof(rangeLocks[0])].gen
+	}
+	return &lockGens[(addr/ptrSize)%lockGenStripes]
+}
+
+// acquire acquires the write lock on m if write is true, and the read lock
+// otherwise. If a lock timeout is set, it returns false if the lock could not
+// be acquired in that time.
+func acquire(m *sync.RWMutex, write bool) bool {
+	timeout := time.Duration(atomic.LoadInt64(&lockTimeout))
+	if timeout <= 0 && atomic.LoadInt32(&rangeLocking) != 0 {
+		timeout = defaultRangeLockTimeout
+	}
+	if timeout <= 0 {
+		if write {
+			m.Lock()
+		} else {
+			m.RLock()
+		}
+		return true
+	}
+
+	// sync.RWMutex cannot be locked with a timeout. So the lock is acquired
+	// by another goroutine, which releases it again if this one stopped
+	// waiting for it.
+	const (
+		waiting = iota
+		taken
+		abandoned
+	)
+	var state int32
+	done := make(chan struct{})
+	go func() {
+		if write {
+			m.Lock()
+		} else {
+			m.RLock()
+		}
+		if !atomic.CompareAndSwapInt32(&state, waiting, taken) {
+			if write {
+				m.Unlock()
+			} else {
+				m.RUnlock()
+			}
+		}
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		if atomic.CompareAndSwapInt32(&state, waiting, abandoned) {
+			return false
+		}
+		// The lock was acquired just as the timeout expired
+		<-done
+		return true
+	}
+}
+
+// rLock acquires the read lock on m for a transaction holding the read locks in
+// rlocks and the write locks in wlocks. Acquiring a lock already held by the
+// transaction does nothing. It returns false if the lock could not be acquired
+// within the lock timeout.
+func rLock(rlocks, wlocks *[]*sync.RWMutex, m *sync.RWMutex) bool {
+	if lockIndex(*rlocks, m) >= 0 || lockIndex(*wlocks, m) >= 0 {
+		return true
+	}
+	if !acquire(m, false) {
+		return false
+	}
+	*rlocks = append(*rlocks, m)
+	return true
+}
+
+// wLock acquires the write lock on m for a transaction holding the read locks
+// in rlocks and the write locks in wlocks. Acquiring a lock already held by the
+// transaction does nothing. If the transaction holds the read lock on m, the
+// lock is upgraded. sync.RWMutex does not support upgrading a lock, so the read
+// lock is released before the write lock is acquired. If another transaction
+// acquired the write lock on m in between, the data read by this transaction
+// may be stale, and the upgrade fails. Writers which lock m outside transactions
+// are not detected. It returns false if the upgrade failed or
+// if the lock could not be acquired within the lock timeout.
+func wLock(rlocks, wlocks *[]*sync.RWMutex, m *sync.RWMutex) bool {
+	if lockIndex(*wlocks, m) >= 0 {
+		return true
+	}
+	gen := lockGen(m)
+	upgrade := false
+	var readGen uint64
+	if i := lockIndex(*rlocks, m); i >= 0 {
+		// No transaction can acquire the write lock while the read lock is
+		// held, so the counter does not change until it is released.
+		upgrade = true
+		readGen = atomic.LoadUint64(gen)
+		m.RUnlock()
+		last := len(*rlocks) - 1
+		(*rlocks)[i] = (*rlocks)[last]
+		(*rlocks)[last] = nil
+		*rlocks = (*rlocks)[:last]
+	}
+	if !acquire(m, true) {
+		return false
+	}
+	if upgrade && atomic.LoadUint64(gen) != readGen {
+		m.Unlock()
+		return false
+	}
+	atomic.AddUint64(gen, 1)
+	*wlocks = append(*wlocks, m)
+	return true
+}
+
+// lockAll acquires the write locks on all mutexes in ms, in the increasing
+// order of their addresses. If all transactions acquire their locks using
+// lockAll, they cannot deadlock with each other. It returns false if any lock
+// could not be acquired within the lock timeout.
+func lockAll(rlocks, wlocks *[]*sync.RWMutex, ms []*sync.RWMutex) bool {
+	sorted := make([]*sync.RWMutex, len(ms))
+	copy(sorted, ms)
+	sort.Slice(sorted, func(i, j int) bool {
+		return uintptr(unsafe.Pointer(sorted[i])) <
+			uintptr(unsafe.Pointer(sorted[j]))
+	})
+	for _, m := range sorted {
+		if !wLock(rlocks, wlocks, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// unlockAll releases all locks in rlocks and wlocks.
+func unlockAll(rlocks, wlocks *[]*sync.RWMutex) {
+	for i, m := range *wlocks {
+		m.Unlock()
+		(*wlocks)[i] = nil
+	}
+	*wlocks = (*wlocks)[:0]
+
+	for i, m := range *rlocks {
+		m.RUnlock()
+		(*rlocks)[i] = nil
+	}
+	*rlocks = (*rlocks)[:0]
+}
+
+const (
+	// Number of locks in the range lock table
+	rangeLockStripes = 1024
+	// Each lock in the range lock table covers aligned memory regions of this
+	// size
+	rangeLockGrain = cacheSize
+)
+
+// paddedRWMutex occupies a whole cacheline, so that adjacent locks in the range
+// lock table do not share a cacheline. gen is the write generation counter of
+// the lock.
+type paddedRWMutex struct {
+	sync.RWMutex
+	gen uint64
+	_   [cacheSize - unsafe.Sizeof(sync.RWMutex{}) - 8]byte
+}
+
+var (
+	// The range lock table. Memory region i, of size rangeLockGrain, is
+	// covered by the lock at index i % rangeLockStripes.
+	rangeLocks [rangeLockStripes]paddedRWMutex
+	// rangeLocking is 1 if range locking is enabled. Accessed atomically.
+	rangeLocking int32
+)
+
+// SetRangeLocking enables or disables locking by address ranges. If enabled,
+// Log(), Log3() and LogRange() acquire the write locks in a table of locks
+// covering the memory being updated, and Read() acquires the read locks
+// covering the memory being read. All these locks are released when the
+// transaction ends or is aborted. This gives strict two-phase locking without
+// the need for the application to map its data to mutexes. As the locks are
+// acquired in the order data is logged, transactions may deadlock, so a lock
+// timeout is always used while range locking is enabled (see SetLockTimeout).
+// Range locking is disabled by default.
+func SetRangeLocking(enable bool) {
+	if enable {
+		atomic.StoreInt32(&rangeLocking, 1)
+	} else {
+		atomic.StoreInt32(&rangeLocking, 0)
+	}
+}
+
+// rangeStripes returns the indices in the range lock table covering 'size'
+// bytes starting at 'ptr', in increasing order.
+func rangeStripes(ptr, size uintptr) []int {
+	if size == 0 {
+		return nil
+	}
+	first := ptr / rangeLockGrain
+	last := (ptr + size - 1) / rangeLockGrain
+	var stripes []int
+	if last-first+1 >= rangeLockStripes {
+		stripes = make([]int, rangeLockStripes)
+		for i := range stripes {
+			stripes[i] = i
+		}
+	} else {
+		stripes = make([]int, 0, last-first+1)
+		for r := first; r <= last; r++ {
+			stripes = append(stripes, int(r%rangeLockStripes))
+		}
+		sort.Ints(stripes)
+	}
+	return stripes
+}
+
+// rangeLock acquires the locks in the range lock table covering 'size' bytes
+// starting at 'ptr', for a transaction holding the read locks in rlocks and the
+// write locks in wlocks. The locks are acquired in increasing order of their
+// index in the table. It returns false if any lock could not be acquired within
+// the lock timeout. It does nothing if range locking is disabled.
+func rangeLock(rlocks, wlocks *[]*sync.RWMutex, ptr unsafe.Pointer,
+	size uintptr, write bool) bool {
+	if atomic.LoadInt32(&rangeLocking) == 0 || size == 0 {
+		return true
+	}
+	for _, s := range rangeStripes(uintptr(ptr), size) {
+		m := &rangeLocks[s].RWMutex
+		if write && !wLock(rlocks, wlocks, m) {
+			return false
+		} else if !write && !rLock(rlocks, wlocks, m) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,4 +1,5 @@
 // +build amd64
+
 package transaction
 
 import (
@@ -60,7 +61,7 @@ func movnt(dst0, src0 unsafe.Pointer, len uintptr) {
 		return
 	}
 
-	align := dst & 15 // Make sure we start with 16B align
+	align := (16 - dst&15) & 15 // Make sure we start with 16B align
 	if align > 0 {
 		memmove_small(dst, src, align)
 		dst += align
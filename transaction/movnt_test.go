@@ -0,0 +1,40 @@
+// +build amd64
+
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package transaction
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestMovntAlignment copies ranges starting at every offset within a 16-byte
+// block. The destination must be 16-byte aligned before movnt copies it in
+// blocks of 16 bytes, which fault on an unaligned address.
+func TestMovntAlignment(t *testing.T) {
+	src := make([]byte, 256)
+	for i := range src {
+		src[i] = byte(i + 1)
+	}
+	for off := 0; off < 32; off++ {
+		for size := 0; size <= 100; size++ {
+			dst := make([]byte, 160)
+			movnt(unsafe.Pointer(&dst[off]), unsafe.Pointer(&src[0]),
+				uintptr(size))
+			for i, b := range dst {
+				want := byte(0)
+				if i >= off && i < off+size {
+					want = src[i-off]
+				}
+				if b != want {
+					t.Fatalf("offset %d, size %d: byte %d is %d, want = %d",
+						off, size, i, b, want)
+				}
+			}
+		}
+	}
+}
@@ -2,10 +2,18 @@ package transaction
 
 import (
 	"runtime"
+	"sync/atomic"
 	"unsafe"
 )
 
-var cacheLineSz = uintptr(64)
+var (
+	cacheLineSz = uintptr(64)
+
+	// Number of cachelines flushed through flushSt so far
+	linesFlushed uint64
+	// Number of fences issued by transactions so far
+	fencesIssued uint64
+)
 
 type (
 	flushSt struct {
@@ -70,11 +78,24 @@ func (f *flushSt) insert(start, size uintptr) bool {
 func (f *flushSt) flushAndDestroy() {
 	if f.data != nil {
 		flushRbTreeMap(f.data)
-		runtime.Fence()
+		fence()
 		f.data = nil
 	}
 }
 
+// flushes the tracked cachelines and issues a single fence. The fence is issued
+// even if no cachelines are tracked, to order any preceding non-temporal stores.
+// The map is cleared in-place so that it can be reused.
+func (f *flushSt) flushAndFence() {
+	if f.data != nil {
+		flushRbTreeMap(f.data)
+		for k := range f.data {
+			delete(f.data, k)
+		}
+	}
+	fence()
+}
+
 // only destroys
 func (f *flushSt) Destroy() {
 	f.data = nil
@@ -84,4 +105,32 @@ func flushRbTreeMap(m map[unsafe.Pointer]uintptr) {
 	for k := range m {
 		runtime.FlushRange(k, cacheLineSz)
 	}
+	atomic.AddUint64(&linesFlushed, uint64(len(m)))
+}
+
+// FlushCount returns the number of cachelines flushed so far by transactions
+// while ending. Flushes are batched and each cacheline is flushed only once per
+// batch, so this can be used to measure the flush cost of transactions.
+func FlushCount() uint64 {
+	return atomic.LoadUint64(&linesFlushed)
+}
+
+// fence issues a fence and counts it.
+func fence() {
+	runtime.Fence()
+	atomic.AddUint64(&fencesIssued, 1)
+}
+
+// persist flushes 'size' bytes starting at 'ptr' and issues a fence, like
+// runtime.PersistRange(), counting the fence.
+func persist(ptr unsafe.Pointer, size uintptr) {
+	runtime.FlushRange(ptr, size)
+	fence()
+}
+
+// FenceCount returns the number of fences issued so far by transactions, while
+// logging data with non-temporal stores or while ending. This can be used with
+// FlushCount() to measure the persistence cost of transactions.
+func FenceCount() uint64 {
+	return atomic.LoadUint64(&fencesIssued)
 }
@@ -0,0 +1,262 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Optimistic transactions do not acquire any locks while they run. Updates are
+ * buffered in a redo log, and data read by the transaction is recorded along
+ * with its version. When the transaction ends, the versions of the data it
+ * read are validated. If none of this data was updated by another transaction
+ * meanwhile, the updates are committed through the redo log. Otherwise the
+ * transaction is aborted, and can be retried.
+ *
+ * Versions are kept in a volatile table with one entry for every stripe of the
+ * range lock table. The lowest bit of an entry is set while a transaction
+ * updating the stripe commits, and the rest of the entry holds the value of a
+ * global clock when the stripe was last updated.
+ * E.g.:
+ *     err := transaction.RunOptimistic(10, func(tx transaction.TX) error {
+ *         if err := tx.Read(unsafe.Pointer(&S.A), 8); err != nil {
+ *             return err
+ *         }
+ *         return tx.Log(&S.B, S.A+1)
+ *     })
+ */
+
+package transaction
+
+import (
+	"errors"
+	"log"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+type (
+	optimisticTx struct {
+		*redoTx
+
+		// Value of stmClock when the transaction began
+		readVersion uint64
+
+		// Stripes of the version table covering the data read by the
+		// transaction
+		readSet map[int]struct{}
+
+		// Stripes of the version table locked by the transaction while it
+		// commits
+		held []int
+
+		// doomed is set if the transaction read data updated after it began
+		doomed bool
+	}
+
+	paddedUint64 struct {
+		v uint64
+		_ [cacheSize - 8]byte
+	}
+)
+
+// ErrConflict is returned when an optimistic transaction read data that was
+// updated by another transaction before it could commit.
+var ErrConflict = errors.New("Optimistic transaction conflicts with another " +
+	"transaction")
+
+var (
+	// The version table. Memory region i, of size rangeLockGrain, is covered by
+	// the entry at index i % rangeLockStripes.
+	stmVersions [rangeLockStripes]paddedUint64
+	// Global clock incremented by every optimistic transaction that commits
+	stmClock uint64
+)
+
+// NewOptimisticTx returns an optimistic transaction handle. Data updated by
+// optimistic transactions must not be updated by other kinds of transactions,
+// as these do not update the version table.
+func NewOptimisticTx() TX {
+	t := NewRedoTx().(*redoTx)
+	t.trackWrites = true
+	return &optimisticTx{redoTx: t, readSet: make(map[int]struct{})}
+}
+
+func releaseOptimisticTx(t *optimisticTx) {
+	t.abort()
+	t.trackWrites = false
+	releaseRedoTx(t.redoTx)
+}
+
+// RunOptimistic runs fn in an optimistic transaction. If the transaction
+// conflicts with another transaction, it is aborted and fn is run again, up to
+// 'attempts' times in total. ErrConflict is returned if the transaction
+// conflicted in every attempt. If fn returns any other error, the transaction
+// is aborted and the error is returned.
+func RunOptimistic(attempts int, fn func(tx TX) error) error {
+	tx := NewOptimisticTx()
+	defer Release(tx)
+	t := tx.(*optimisticTx)
+	for i := 0; i < attempts; i++ {
+		t.Begin()
+		err := fn(t)
+		if err == nil && t.End() {
+			return nil
+		}
+		t.abort()
+		if err != nil && err != ErrConflict {
+			return err
+		}
+		runtime.Gosched()
+	}
+	return ErrConflict
+}
+
+// Begin starts a transaction. Optimistic transactions only support the "sync"
+// durability level.
+func (t *optimisticTx) Begin(d ...Durability) error {
+	if code, err := durabilityCode(d); err != nil || code != durSync {
+		return errors.New("[optimisticTx] Begin: Only sync durability is " +
+			"supported")
+	}
+	if t.level == 0 {
+		t.readVersion = atomic.LoadUint64(&stmClock)
+		t.doomed = false
+		for s := range t.readSet {
+			delete(t.readSet, s)
+		}
+	}
+	return t.redoTx.Begin()
+}
+
+// Read records the versions of 'size' bytes of data starting at 'ptr', which
+// are validated when the transaction ends. It returns ErrConflict if the data
+// was updated after the transaction began. If so, End() aborts the
+// transaction.
+func (t *optimisticTx) Read(ptr unsafe.Pointer, size uintptr) error {
+	for _, s := range rangeStripes(uintptr(ptr), size) {
+		v := atomic.LoadUint64(&stmVersions[s].v)
+		if v&1 != 0 || v>>1 > t.readVersion {
+			t.doomed = true
+			return ErrConflict
+		}
+		t.readSet[s] = struct{}{}
+	}
+	return nil
+}
+
+// ReadLog returns the latest value staged in the redo log, like redo
+// transactions do. If it is called with a pointer, the data pointed to is
+// recorded as read by the transaction.
+func (t *optimisticTx) ReadLog(intf ...interface{}) interface{} {
+	if len(intf) == 1 {
+		switch v := intf[0].(type) {
+		case unsafe.Pointer:
+			t.Read(v, 1)
+		default:
+			ptrV := reflect.ValueOf(v)
+			if ptrV.Kind() == reflect.Ptr {
+				t.Read(unsafe.Pointer(ptrV.Pointer()), ptrV.Type().Elem().Size())
+			}
+		}
+	}
+	return t.redoTx.ReadLog(intf...)
+}
+
+func (t *optimisticTx) Exec(intf ...interface{}) (retVal []reflect.Value,
+	err error) {
+	retVal, ended, err := execTx("optimisticTx", t, &t.level, intf)
+	if err == nil && !ended {
+		return retVal, ErrConflict
+	}
+	return retVal, err
+}
+
+/* When the outermost transaction ends, the stripes of the version table covering
+ * the data updated are locked, and the versions of the data read are validated.
+ * If validation succeeds, the updates are committed through the redo log and
+ * the stripes are unlocked with a new version. Returns false if validation
+ * failed. The transaction is aborted in this case.
+ */
+func (t *optimisticTx) End() bool {
+	if t.level != 1 {
+		return t.redoTx.End()
+	}
+	if t.doomed || !t.lockWriteSet() {
+		t.abort()
+		return false
+	}
+	writeVersion := atomic.AddUint64(&stmClock, 1)
+	if !t.validate() {
+		t.unlockWriteSet(0)
+		t.abort()
+		return false
+	}
+	t.redoTx.End()
+	t.unlockWriteSet(writeVersion)
+	return true
+}
+
+// lockWriteSet locks the stripes of the version table covering the data
+// updated by the transaction, in increasing order. It returns false if any
+// stripe is locked by another transaction.
+func (t *optimisticTx) lockWriteSet() bool {
+	var stripes []int
+	for _, r := range t.writeSet {
+		stripes = append(stripes, rangeStripes(r.start, r.size)...)
+	}
+	sort.Ints(stripes)
+	for i, s := range stripes {
+		if i > 0 && s == stripes[i-1] {
+			continue
+		}
+		addr := &stmVersions[s].v
+		v := atomic.LoadUint64(addr)
+		if v&1 != 0 || !atomic.CompareAndSwapUint64(addr, v, v|1) {
+			t.unlockWriteSet(0)
+			return false
+		}
+		t.held = append(t.held, s)
+	}
+	return true
+}
+
+// unlockWriteSet unlocks the stripes locked by lockWriteSet. If version is not
+// zero, the stripes are updated to this version.
+func (t *optimisticTx) unlockWriteSet(version uint64) {
+	for _, s := range t.held {
+		addr := &stmVersions[s].v
+		if version != 0 {
+			atomic.StoreUint64(addr, version<<1)
+		} else {
+			atomic.StoreUint64(addr, atomic.LoadUint64(addr)&^1)
+		}
+	}
+	t.held = t.held[:0]
+}
+
+// validate returns true if none of the data read by the transaction was
+// updated by another transaction after this transaction began.
+func (t *optimisticTx) validate() bool {
+	for s := range t.readSet {
+		v := atomic.LoadUint64(&stmVersions[s].v)
+		if v>>1 > t.readVersion {
+			return false
+		}
+		if v&1 != 0 {
+			i := sort.SearchInts(t.held, s)
+			if i == len(t.held) || t.held[i] != s {
+				// Locked by another transaction which is committing
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *optimisticTx) abort() error {
+	if len(t.held) != 0 {
+		log.Panic("[optimisticTx] abort: Version table stripes still locked")
+	}
+	return t.redoTx.abort()
+}
@@ -0,0 +1,204 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Two-phase commit of redo transactions. Instead of ending the outermost
+ * transaction, Prepare() persists its log and marks it prepared under an ID
+ * chosen by the application, such as the ID of a distributed transaction. The
+ * updates are applied when CommitPrepared() is called with this ID, and are
+ * dropped when AbortPrepared() is called. A prepared transaction survives a
+ * crash: recovery neither applies nor drops its log, and PreparedTxs() returns
+ * the IDs of the prepared transactions found, so that the application can
+ * decide their outcome.
+ * E.g.:
+ *     tx := transaction.NewRedoTx()
+ *     tx.Begin()
+ *     tx.Log(&S.A, 10)
+ *     err := transaction.Prepare(tx, "xid-42") // S.A is unchanged
+ *     // Once all participants are prepared
+ *     transaction.CommitPrepared("xid-42") // S.A = 10 after this
+ *
+ * The status of a redo transaction moves from active to prepared to committed.
+ * Once prepared, the transaction handle belongs to the prepared transaction,
+ * and is released when its outcome is decided. The locks held by the
+ * transaction are held till then. Locks are not held again after a restart, so
+ * the memory updated by a prepared transaction found during recovery is
+ * protected instead by rejecting transactions which log any part of it, with
+ * ErrPrepared, until its outcome is decided.
+ */
+
+package transaction
+
+import (
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ErrPrepared is returned when a transaction logs data updated by a prepared
+// transaction found during recovery, whose outcome is not yet decided. The
+// data is not logged.
+var ErrPrepared = errors.New("Data is updated by a prepared transaction " +
+	"whose outcome is not decided")
+
+var (
+	preparedMu sync.Mutex
+	// Prepared transactions whose outcome is not yet decided, by ID
+	preparedTxs map[string]*redoTx
+	// The undecided prepared transactions found during recovery
+	recoveredTxs map[*redoTx]bool
+	// Memory ranges updated by the transactions in recoveredTxs, stored as
+	// []memRange
+	preparedRanges atomic.Value
+)
+
+// Prepare persists the log of the redo transaction 'tx' and marks it prepared
+// with the ID 'id', in place of ending the outermost transaction. 'tx' must not
+// be used or released after this. An error is returned if the transaction is
+// not an outermost redo transaction with sync durability, or if a prepared
+// transaction with this ID exists.
+func Prepare(tx TX, id string) error {
+	t, ok := tx.(*redoTx)
+	if !ok {
+		return errors.New("[redoTx] Prepare: Only redo transactions can be " +
+			"prepared")
+	}
+	if t.level != 1 {
+		return errors.New("[redoTx] Prepare: Must be called in place of " +
+			"End() of the outermost transaction")
+	}
+	if t.durability != durSync {
+		return errors.New("[redoTx] Prepare: Transaction must have sync " +
+			"durability")
+	}
+	if id == "" {
+		return errors.New("[redoTx] Prepare: ID must not be empty")
+	}
+	preparedMu.Lock()
+	defer preparedMu.Unlock()
+	if _, ok := preparedTxs[id]; ok {
+		return errors.New("[redoTx] Prepare: A transaction with ID " + id +
+			" is prepared")
+	}
+	xid := pmake([]byte, len(id))
+	copy(xid, id)
+	runtime.PersistRange(unsafe.Pointer(&xid[0]), uintptr(len(xid)))
+	t.xid = xid
+
+	// The log, the contents of new slices and the ID are persisted before
+	// the transaction is marked prepared.
+	t.insertLog()
+	t.insertSlices(0)
+	t.fs.flushAndFence()
+	runtime.PersistRange(t.setStatus(redoPrepared))
+	t.level = 0
+	preparedTxs[id] = t
+	return nil
+}
+
+// CommitPrepared applies the updates of the prepared transaction with the ID
+// 'id', and releases its transaction handle.
+func CommitPrepared(id string) error {
+	t, err := takePrepared(id)
+	if err != nil {
+		return errors.New("[redoTx] CommitPrepared: " + err.Error())
+	}
+	runtime.PersistRange(t.markCommitted())
+	if t.updatesVersioned() {
+		t.snapshotCommit()
+	} else {
+		t.commit(false)
+	}
+	t.xid = nil
+	redoArray.clearBit(t.index)
+	return nil
+}
+
+// AbortPrepared drops the updates of the prepared transaction with the ID
+// 'id', and releases its transaction handle.
+func AbortPrepared(id string) error {
+	t, err := takePrepared(id)
+	if err != nil {
+		return errors.New("[redoTx] AbortPrepared: " + err.Error())
+	}
+	runtime.PersistRange(t.setStatus(redoActive))
+	t.abort()
+	t.xid = nil
+	redoArray.clearBit(t.index)
+	return nil
+}
+
+// PreparedTxs returns the IDs of all prepared transactions whose outcome is not
+// yet decided, in sorted order. After a restart, these are the transactions
+// found prepared in the log by Init.
+func PreparedTxs() []string {
+	preparedMu.Lock()
+	defer preparedMu.Unlock()
+	ids := make([]string, 0, len(preparedTxs))
+	for id := range preparedTxs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// takePrepared removes the prepared transaction with the ID 'id' from the list
+// of prepared transactions and returns it.
+func takePrepared(id string) (*redoTx, error) {
+	preparedMu.Lock()
+	defer preparedMu.Unlock()
+	t, ok := preparedTxs[id]
+	if !ok {
+		return nil, errors.New("No transaction prepared with ID " + id)
+	}
+	delete(preparedTxs, id)
+	if recoveredTxs[t] {
+		delete(recoveredTxs, t)
+		updatePreparedRanges()
+	}
+	return t, nil
+}
+
+// recoverPrepared records the prepared transactions found during recovery, and
+// the memory ranges they update. These are not locked after a restart.
+func recoverPrepared(txs []*redoTx) {
+	preparedMu.Lock()
+	defer preparedMu.Unlock()
+	preparedTxs = make(map[string]*redoTx)
+	recoveredTxs = make(map[*redoTx]bool)
+	for _, t := range txs {
+		preparedTxs[string(t.xid)] = t
+		recoveredTxs[t] = true
+	}
+	updatePreparedRanges()
+}
+
+// updatePreparedRanges stores the memory ranges updated by the transactions in
+// recoveredTxs. The caller must hold preparedMu.
+func updatePreparedRanges() {
+	var ranges []memRange
+	for t := range recoveredTxs {
+		for i := 0; i < t.tail; i++ {
+			ranges = append(ranges, memRange{uintptr(t.log[i].ptr),
+				uintptr(t.log[i].size)})
+		}
+	}
+	preparedRanges.Store(ranges)
+}
+
+// checkPrepared returns ErrPrepared if any of the 'size' bytes starting at
+// 'ptr' is updated by an undecided prepared transaction found during recovery.
+func checkPrepared(ptr unsafe.Pointer, size uintptr) error {
+	ranges, _ := preparedRanges.Load().([]memRange)
+	start := uintptr(ptr)
+	for _, r := range ranges {
+		if start < r.start+r.size && r.start < start+size {
+			return ErrPrepared
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Read-only transactions. These only acquire read locks, and have no log in
+ * persistent memory. Any call to update data through the transaction returns
+ * ErrReadOnly. Read-only transaction handles are kept in a volatile pool of
+ * their own, so readers never wait for undo or redo transaction handles.
+ * E.g.:
+ *     tx := transaction.NewReadTx()
+ *     tx.Begin()
+ *     tx.RLock(m)
+ *     a := tx.ReadLog(&S.A).(int)
+ *     tx.End() // releases the read lock on m
+ *     transaction.Release(tx)
+ */
+
+package transaction
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// ErrReadOnly is returned when a read-only transaction is used to update data
+// or to acquire a write lock.
+var ErrReadOnly = errors.New("Cannot update data in a read-only transaction")
+
+type readTx struct {
+	level  int
+	rlocks []*sync.RWMutex
+	// Read-only transactions never hold write locks. This is kept to share the
+	// locking functions with the other transactions.
+	wlocks []*sync.RWMutex
+}
+
+var readTxPool = sync.Pool{
+	New: func() interface{} {
+		return &readTx{
+			rlocks: make([]*sync.RWMutex, 0, 0),
+			wlocks: make([]*sync.RWMutex, 0, 0),
+		}
+	},
+}
+
+// NewReadTx returns a read-only transaction handle. It never blocks, as the
+// handles are allocated in volatile memory as needed.
+func NewReadTx() TX {
+	return readTxPool.Get().(*readTx)
+}
+
+func releaseReadTx(t *readTx) {
+	t.abort()
+	readTxPool.Put(t)
+}
+
+// Begin starts a transaction. The durability level is ignored, as read-only
+// transactions do not update any data.
+func (t *readTx) Begin(d ...Durability) error {
+	t.level++
+	return nil
+}
+
+// End releases all locks held by the transaction when the outermost
+// transaction ends. Returns a bool indicating if it is safe to release the
+// transaction handle.
+func (t *readTx) End() bool {
+	if t.level == 0 {
+		return true
+	}
+	t.level--
+	if t.level == 0 {
+		unlockAll(&t.rlocks, &t.wlocks)
+		return true
+	}
+	return false
+}
+
+func (t *readTx) Log(intf ...interface{}) error {
+	return ErrReadOnly
+}
+
+func (t *readTx) Log2(src, dst unsafe.Pointer, size uintptr) error {
+	return ErrReadOnly
+}
+
+func (t *readTx) Log3(src unsafe.Pointer, size uintptr) error {
+	return ErrReadOnly
+}
+
+func (t *readTx) LogRange(slice interface{}, start int,
+	elems interface{}) error {
+	return ErrReadOnly
+}
+
+// ReadLog reads data in-place, with the same syntax as in undo transactions.
+func (t *readTx) ReadLog(intf ...interface{}) (retVal interface{}) {
+	if len(intf) == 2 {
+		s := reflect.Indirect(reflect.ValueOf(intf[0]))
+		return s.Index(intf[1].(int)).Interface()
+	} else if len(intf) == 3 {
+		s := reflect.Indirect(reflect.ValueOf(intf[0]))
+		return s.Slice(intf[1].(int), intf[2].(int)).Interface()
+	} else if len(intf) != 1 {
+		panic("[readTx] ReadLog: Incorrect number of args passed")
+	}
+	ptrV := reflect.ValueOf(intf[0])
+	switch ptrV.Kind() {
+	case reflect.UnsafePointer:
+		retVal = intf[0]
+	case reflect.Ptr:
+		retVal = readThroughPtr(ptrV)
+	default:
+		panic("[readTx] ReadLog: Arg must be pointer")
+	}
+	return retVal
+}
+
+func (t *readTx) Exec(intf ...interface{}) (retVal []reflect.Value,
+	err error) {
+	retVal, _, err = execTx("readTx", t, &t.level, intf)
+	return retVal, err
+}
+
+func (t *readTx) RLock(m *sync.RWMutex) error {
+	if !rLock(&t.rlocks, &t.wlocks, m) {
+		t.abort()
+		return ErrDeadlock
+	}
+	return nil
+}
+
+// WLock returns ErrReadOnly, as read-only transactions never acquire write
+// locks.
+func (t *readTx) WLock(m *sync.RWMutex) error {
+	return ErrReadOnly
+}
+
+func (t *readTx) Lock(m *sync.RWMutex) error {
+	return t.WLock(m)
+}
+
+func (t *readTx) LockAll(ms ...*sync.RWMutex) error {
+	return ErrReadOnly
+}
+
+// Read acquires the read locks in the range lock table covering 'size' bytes
+// starting at 'ptr'. It does nothing if range locking is disabled.
+func (t *readTx) Read(ptr unsafe.Pointer, size uintptr) error {
+	if !rangeLock(&t.rlocks, &t.wlocks, ptr, size, false) {
+		t.abort()
+		return ErrDeadlock
+	}
+	return nil
+}
+
+// abort releases all locks held by the transaction. There is nothing to
+// revert, as read-only transactions do not update data.
+func (t *readTx) abort() {
+	t.level = 0
+	unlockAll(&t.rlocks, &t.wlocks)
+}
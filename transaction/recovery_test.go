@@ -0,0 +1,255 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package transaction
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+var poolOnce sync.Once
+
+// initTestPool initializes persistent memory and new undo and redo log
+// handles. The handles are recovered by restartUndo() and restartRedo() as they
+// are when the application restarts.
+func initTestPool(t *testing.T) {
+	poolOnce.Do(func() {
+		os.Remove("recovery_testFile")
+		if _, err := runtime.PmemInit("recovery_testFile"); err != nil {
+			t.Fatal("Persistent memory initialization failed")
+		}
+	})
+	initUndoTx(nil)
+	initRedoTx(nil)
+}
+
+// restartUndo recovers the undo log handles, as done by Init() after a crash.
+// The handles are left as they were when the application crashed.
+func restartUndo() {
+	initUndoTx(unsafe.Pointer(txHeaderPtr))
+}
+
+// restartRedo recovers the redo log handles, as done by Init() after a crash.
+// The handles are left as they were when the application crashed.
+func restartRedo() {
+	initRedoTx(unsafe.Pointer(headerPtr))
+}
+
+func TestRecoverPrepared(t *testing.T) {
+	initTestPool(t)
+	a := pnew(int)
+	b := pnew(int)
+	tx := NewRedoTx()
+	tx.Begin()
+	tx.Log(a, 10)
+	if err := Prepare(tx, "xid-1"); err != nil {
+		t.Fatal(err)
+	}
+	restartRedo()
+
+	if ids := PreparedTxs(); len(ids) != 1 || ids[0] != "xid-1" {
+		t.Fatalf("want = [xid-1], got = %v", ids)
+	}
+	for i := 0; i < logNum; i++ {
+		if redoHandle(i).fs.data != nil {
+			t.Fatal("Flush map of the previous run not reset by recovery")
+		}
+	}
+	if *a != 0 {
+		t.Fatalf("want = 0, got = %d", *a)
+	}
+	tx = NewRedoTx()
+	tx.Begin()
+	if err := tx.Log(a, 20); err != ErrPrepared {
+		t.Fatalf("want = %v, got = %v", ErrPrepared, err)
+	}
+	if err := tx.Log(b, 20); err != nil {
+		t.Fatal(err)
+	}
+	tx.End()
+	if err := CommitPrepared("xid-1"); err != nil {
+		t.Fatal(err)
+	}
+	if *a != 10 || *b != 20 {
+		t.Fatalf("want = 10 20, got = %d %d", *a, *b)
+	}
+	// Data updated by the decided transaction can be logged again
+	tx.Begin()
+	if err := tx.Log(a, 30); err != nil {
+		t.Fatal(err)
+	}
+	tx.End()
+	releaseRedoTx(tx.(*redoTx))
+
+	restartRedo()
+	if ids := PreparedTxs(); len(ids) != 0 {
+		t.Fatalf("want = [], got = %v", ids)
+	}
+	if *a != 30 {
+		t.Fatalf("want = 30, got = %d", *a)
+	}
+}
+
+func TestRecoverSegments(t *testing.T) {
+	initTestPool(t)
+	SetMaxHandles("undo", 2*logNum)
+	SetMaxHandles("redo", 2*logNum)
+	defer SetMaxHandles("undo", 0)
+	defer SetMaxHandles("redo", 0)
+	a := pnew(int)
+	b := pnew(int)
+	c := pnew(int)
+
+	// Use up the first segment of handles, so that the transactions below
+	// get handles in a second segment.
+	var utx TX
+	for i := 0; i <= logNum; i++ {
+		utx = NewUndoTx()
+	}
+	if utx.(*undoTx).index < logNum {
+		t.Fatalf("want undo handle index >= %d, got = %d", logNum,
+			utx.(*undoTx).index)
+	}
+	utx.Begin()
+	utx.Log3(unsafe.Pointer(a), unsafe.Sizeof(*a))
+	*a = 10
+	var rtx TX
+	for i := 0; i <= logNum; i++ {
+		rtx = NewRedoTx()
+	}
+	if rtx.(*redoTx).index < logNum {
+		t.Fatalf("want redo handle index >= %d, got = %d", logNum,
+			rtx.(*redoTx).index)
+	}
+	rtx.Begin()
+	rtx.Log(b, 20)
+	if err := Prepare(rtx, "xid-seg"); err != nil {
+		t.Fatal(err)
+	}
+	rtx = NewRedoTx()
+	rtx.Begin()
+	rtx.Log(c, 30)
+
+	restartUndo()
+	restartRedo()
+	if n := len(uHandles.Load().([]*[logNum]undoTx)); n != 2 {
+		t.Fatalf("want 2 segments of undo handles, got = %d", n)
+	}
+	if n := len(rHandles.Load().([]*redoSegment)); n != 2 {
+		t.Fatalf("want 2 segments of redo handles, got = %d", n)
+	}
+	if *a != 0 {
+		t.Fatalf("want = 0, got = %d", *a)
+	}
+	if ids := PreparedTxs(); len(ids) != 1 || ids[0] != "xid-seg" {
+		t.Fatalf("want = [xid-seg], got = %v", ids)
+	}
+	if err := CommitPrepared("xid-seg"); err != nil {
+		t.Fatal(err)
+	}
+	if *b != 20 || *c != 0 {
+		t.Fatalf("want = 20 0, got = %d %d", *b, *c)
+	}
+}
+
+func TestRecoverLegacyLogs(t *testing.T) {
+	initTestPool(t)
+	a := pnew(int)
+	b := pnew(int)
+
+	// A legacy undo log with a transaction pending in its first handle
+	tx := NewUndoTx()
+	tx.Begin()
+	tx.Log3(unsafe.Pointer(a), unsafe.Sizeof(*a))
+	*a = 10
+	uLegacy := pnew(legacyUndoTxHeader)
+	uLegacy.logData = txHeaderPtr.seg.logData
+	uLegacy.magic = legacyMagic
+	head := Init(unsafe.Pointer(uLegacy), "undo")
+	if head == unsafe.Pointer(uLegacy) || head != unsafe.Pointer(txHeaderPtr) {
+		t.Fatal("Legacy undo log not migrated to a new log head")
+	}
+	if txHeaderPtr.magic != magic {
+		t.Fatalf("want magic = %d, got = %d", magic, txHeaderPtr.magic)
+	}
+	if *a != 0 {
+		t.Fatalf("want = 0, got = %d", *a)
+	}
+
+	// A legacy redo log with a committed transaction in its last handle
+	rLegacy := pnew(legacyRedoTxHeader)
+	for i := range rLegacy.logPtr {
+		rLegacy.logPtr[i] = pnew(legacyRedoTx)
+	}
+	data := pnew(int)
+	*data = 20
+	ltx := rLegacy.logPtr[logNum-1]
+	ltx.log = pmake([]entry, 1)
+	ltx.log[0] = entry{ptr: unsafe.Pointer(b), data: unsafe.Pointer(data),
+		size: int(unsafe.Sizeof(*b))}
+	ltx.tail = 1
+	ltx.committed = true
+	rLegacy.magic = legacyMagic
+	head = Init(unsafe.Pointer(rLegacy), "redo")
+	if head == unsafe.Pointer(rLegacy) || head != unsafe.Pointer(headerPtr) {
+		t.Fatal("Legacy redo log not migrated to a new log head")
+	}
+	if *b != 20 || ltx.committed {
+		t.Fatalf("want = 20 false, got = %d %v", *b, ltx.committed)
+	}
+	rtx := NewRedoTx()
+	rtx.Begin()
+	rtx.Log(b, 30)
+	rtx.End()
+	releaseRedoTx(rtx.(*redoTx))
+	if *b != 30 {
+		t.Fatalf("want = 30, got = %d", *b)
+	}
+}
+
+func TestRecoverResumable(t *testing.T) {
+	initTestPool(t)
+	a := pnew(int)
+	b := pnew([4]int)
+	c := pnew(int)
+	rtx, err := NewResumableRedo("recover-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtx.Begin()
+	rtx.Log(a, 10)
+	rtx.Log3(unsafe.Pointer(b), unsafe.Sizeof(*b))
+	(*[4]int)(rtx.ReadLog(unsafe.Pointer(b)).(unsafe.Pointer))[1] = 1
+	rtx.End()
+	rtx.Begin()
+	rtx.Log(c, 30)
+	rtx.Log3(unsafe.Pointer(&b[2]), unsafe.Sizeof(b[2]))
+	*(*int)(rtx.ReadLog(unsafe.Pointer(&b[2])).(unsafe.Pointer)) = 2
+	rtx.End()
+	restartRedo()
+
+	// Only the entries logged using Log3() are read as ranges of bytes
+	rtx, err = ResumeRedo("recover-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := rtx.(*resumableTx).redoTx
+	if len(tx.rawEntries) != 2 {
+		t.Fatalf("want 2 raw entries, got = %d", len(tx.rawEntries))
+	}
+	if v := rtx.ReadLog(&b[1]).(int); v != 1 {
+		t.Fatalf("want = 1, got = %d", v)
+	}
+	if err := rtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if *a != 10 || *b != [4]int{0, 1, 2, 0} || *c != 30 {
+		t.Fatalf("want = 10 [0 1 2 0] 30, got = %d %v %d", *a, *b, *c)
+	}
+}
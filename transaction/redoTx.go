@@ -45,7 +45,10 @@ import (
 	"reflect"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -63,27 +66,159 @@ type (
 		index int
 
 		// num of entries which can be stored in log
-		nEntry    int
-		committed bool
-		m         map[unsafe.Pointer]int
-		rlocks    []*sync.RWMutex
-		wlocks    []*sync.RWMutex
+		nEntry int
+		// Status of the transaction: active, prepared or committed
+		status int
+		m      map[unsafe.Pointer]int
+		rlocks []*sync.RWMutex
+		wlocks []*sync.RWMutex
 
 		// record which log entries store sliceheader, and store the size of
 		// each element in that slice. This is only used when transaction ends
 		// successfully. So this structure is stored in volatile memory.
 		storeSliceHdr []pair
+
+		// record which log entries were created by Log3() or LogRange() and
+		// store a range of bytes. ReadLog() also looks for ranges containing
+		// the address being read, and uses the entry which was logged last.
+		rawEntries []int
+
+		// Pointer to the arena in persistent memory where logged data without
+		// pointers is stored. first points to the first linked array while
+		// curr points to the currently used array which may or may not be
+		// equal to first. dataTail is the offset in curr where new data would
+		// be stored.
+		first    *uLogData
+		curr     *uLogData
+		dataTail int
+
+		// A buffer to compose log entries before they are copied to the log
+		// using non-temporal stores.
+		entryBuf entry
+
+		// Scratch space for the pointers found in a range logged by Log3()
+		ptrArray []unsafe.Pointer
+
+		// ntStores is set when log entries are written using non-temporal
+		// stores, until they are fenced when the transaction ends.
+		ntStores bool
+
+		// Indices of the log entries written using regular stores, which are
+		// flushed when the transaction ends. If logGrown is set, the entries
+		// were copied to a larger log array, and all of them are flushed.
+		regEntries []int
+		logGrown   bool
+
+		// Cachelines to be flushed when the transaction ends. The field is
+		// part of the handle in persistent memory, but its map is allocated
+		// in volatile memory, so it is reset when the handle is recovered.
+		fs flushSt
+
+		// If trackWrites is true, the memory ranges updated by the transaction
+		// are recorded in writeSet. This is used by optimistic transactions,
+		// which buffer their updates in a redo transaction.
+		trackWrites bool
+		writeSet    []memRange
+
+		// Durability level of the ongoing transaction. This is persisted
+		// along with the log, so that recovery knows if the updates must be
+		// applied.
+		durability int
+
+		// If the last transaction ended with deferred durability, applied is
+		// closed once its updates are applied. This is stored in volatile
+		// memory.
+		applied chan struct{}
+
+		// name is set if this is a resumable transaction, which is kept
+		// uncommitted across restarts until it is committed or discarded.
+		// ckpt holds the state of its log when it was last checkpointed.
+		name []byte
+		ckpt redoCkpt
+
+		// group is set if the handle logs updates of a shared transaction.
+		// The updates are applied only if the group is committed.
+		group *redoGroup
+
+		// ID given to the transaction when it is prepared for two-phase
+		// commit
+		xid []byte
+	}
+
+	// The state of the log of a resumable transaction at its last checkpoint.
+	// The entries before tail and the data they point to are never updated
+	// once checkpointed.
+	redoCkpt struct {
+		log      []entry
+		tail     int
+		curr     *uLogData
+		dataTail int
+		// Indices of the entries logged as ranges of bytes, in the order they
+		// were logged. Elements past len(raw) may be overwritten.
+		raw []int
+	}
+
+	// A range of memory of 'size' bytes starting at 'start'
+	memRange struct {
+		start uintptr
+		size  uintptr
+	}
+
+	// A segment of redo log handles. The header holds the first segment. More
+	// segments are linked to the last one as the number of handles grows.
+	redoSegment struct {
+		logPtr [logNum]*redoTx
+		next   *redoSegment
 	}
 
 	redoTxHeader struct {
+		magic int
+		seg   redoSegment
+	}
+
+	// Layouts of the redo log handles and header before the handles were
+	// split into segments, identified by legacyMagic
+	legacyRedoTx struct {
+		log           []entry
+		tail          int
+		level         int
+		index         int
+		nEntry        int
+		committed     bool
+		m             map[unsafe.Pointer]int
+		rlocks        []*sync.RWMutex
+		wlocks        []*sync.RWMutex
+		storeSliceHdr []pair
+	}
+	legacyRedoTxHeader struct {
 		magic  int
-		logPtr [logNum]*redoTx
+		logPtr [logNum]*legacyRedoTx
 	}
 )
 
 var (
 	headerPtr *redoTxHeader
 	redoArray *bitmap
+	// Segments of redo log handles, stored as a list of type []*redoSegment.
+	rHandles atomic.Value
+	// Maximum number of redo log handles, or 0 if there is no limit. Accessed
+	// atomically.
+	maxRedoHandles int64
+)
+
+const (
+	// Status of a redo transaction. A prepared transaction is neither
+	// committed nor aborted by recovery, and waits for the application to
+	// decide its outcome.
+	redoActive = iota
+	redoPrepared
+	redoCommitted
+)
+
+const (
+	// Initial size of the redo log arena in persistent memory. The arena is
+	// allocated when a handle logs data for the first time.
+	rLogInitSize = 65536
 )
 
 /* Does the first time initialization, else restores log structure and
@@ -91,46 +226,161 @@ var (
  * so the application can store this in its pmem appRoot.
  */
 func initRedoTx(logHeadPtr unsafe.Pointer) unsafe.Pointer {
-	redoArray = newBitmap(logNum)
+	rHandles.Store([]*redoSegment(nil))
+	// Resumable and prepared transactions found in the log
+	var named, prepared []*redoTx
 	if logHeadPtr == nil {
 		// First time initialization
 		headerPtr = pnew(redoTxHeader)
-		for i := 0; i < logNum; i++ {
-			headerPtr.logPtr[i] = _initRedoTx(NumEntries, i)
-		}
+		initRedoSegment(&headerPtr.seg, 0)
+		addRedoHandles(&headerPtr.seg)
 		// Write the magic constant after the transaction handles are persisted.
 		// NewRedoTx() can then check this constant to ensure all tx handles
 		// are properly initialized before releasing any.
-		runtime.PersistRange(unsafe.Pointer(&headerPtr.logPtr), logNum*ptrSize)
 		headerPtr.magic = magic
 		runtime.PersistRange(unsafe.Pointer(&headerPtr.magic), ptrSize)
 		logHeadPtr = unsafe.Pointer(headerPtr)
 	} else {
+		if (*redoTxHeader)(logHeadPtr).magic == legacyMagic {
+			// The legacy handles cannot be reused, so the committed
+			// transactions are applied and a new log is allocated.
+			recoverLegacyRedo(logHeadPtr)
+			return initRedoTx(nil)
+		}
 		headerPtr = (*redoTxHeader)(logHeadPtr)
 		if headerPtr.magic != magic {
 			log.Fatal("redoTxHeader magic does not match!")
 		}
 
 		// Depending on committed status of transactions, flush changes to
-		// data structures or delete all log entries.
+		// data structures or delete all log entries. This is done for the
+		// handles in all segments.
 		var tx *redoTx
-		for i := 0; i < logNum; i++ {
-			tx = headerPtr.logPtr[i]
-			tx.index = i
-			tx.wlocks = make([]*sync.RWMutex, 0, 0) // Resetting volatile locks
-			tx.rlocks = make([]*sync.RWMutex, 0, 0) // before checking for data
-			tx.storeSliceHdr = make([]pair, 0, 0)
-			if tx.committed {
-				tx.commit(true)
-			} else {
-				tx.abort()
+		for seg := &headerPtr.seg; seg != nil; seg = seg.next {
+			base := (len(addRedoHandles(seg)) - 1) * logNum
+			for i := 0; i < logNum; i++ {
+				tx = seg.logPtr[i]
+				tx.index = base + i
+				tx.wlocks = make([]*sync.RWMutex, 0, 0) // Resetting volatile locks
+				tx.rlocks = make([]*sync.RWMutex, 0, 0) // before checking for data
+				tx.storeSliceHdr = make([]pair, 0, 0)
+				tx.rawEntries = make([]int, 0, 0)
+				tx.m = make(map[unsafe.Pointer]int)
+				// The map of cachelines to be flushed was persisted along
+				// with the handle, and points into the previous process.
+				tx.fs = flushSt{}
+				tx.ptrArray = nil
+				tx.regEntries = nil
+				tx.trackWrites = false
+				tx.writeSet = nil
+				tx.applied = nil
+				if tx.name != nil {
+					if recoverResumable(tx) {
+						named = append(named, tx)
+					}
+				} else if tx.group != nil {
+					recoverShared(tx)
+				} else if tx.status == redoPrepared {
+					prepared = append(prepared, tx)
+				} else if tx.status == redoCommitted &&
+					tx.durability != durNone {
+					tx.commit(true)
+				} else {
+					tx.abort()
+				}
 			}
 		}
 	}
 
+	redoArray = newBitmap(logNum)
+	for i := 1; i < len(rHandles.Load().([]*redoSegment)); i++ {
+		redoArray.addChunk()
+	}
+	redoArray.grow = growRedoHandles
+	resumables = make(map[string]*resumable)
+	for _, tx := range named {
+		// Handles of resumable transactions stay in use till the transactions
+		// are committed or discarded.
+		redoArray.setBit(tx.index)
+		resumables[string(tx.name)] = &resumable{tx: tx}
+	}
+	for _, tx := range prepared {
+		redoArray.setBit(tx.index)
+	}
+	recoverPrepared(prepared)
 	return logHeadPtr
 }
 
+// recoverLegacyRedo applies the updates of the committed transactions in a redo
+// log header with the legacy layout. Other transactions are dropped along with
+// the legacy log. The legacy log stays usable if a crash happens before a new
+// log is stored in its place, as applying the updates again is harmless.
+func recoverLegacyRedo(logHeadPtr unsafe.Pointer) {
+	legacy := (*legacyRedoTxHeader)(logHeadPtr)
+	for _, tx := range legacy.logPtr {
+		if !tx.committed {
+			continue
+		}
+		for i := 0; i < tx.tail; i++ {
+			e := &tx.log[i]
+			if !runtime.InPmem(uintptr(e.ptr)) {
+				continue
+			}
+			oldData := (*[maxInt]byte)(e.ptr)[:e.size:e.size]
+			copy(oldData, (*[maxInt]byte)(e.data)[:e.size:e.size])
+			runtime.PersistRange(e.ptr, uintptr(e.size))
+		}
+		tx.committed = false
+		runtime.PersistRange(unsafe.Pointer(&tx.committed),
+			unsafe.Sizeof(tx.committed))
+	}
+}
+
+// initRedoSegment allocates the redo log handles of a segment and persists the
+// segment. 'base' is the index of the first handle in the segment.
+func initRedoSegment(seg *redoSegment, base int) {
+	for i := 0; i < logNum; i++ {
+		seg.logPtr[i] = _initRedoTx(NumEntries, base+i)
+	}
+	runtime.PersistRange(unsafe.Pointer(seg), unsafe.Sizeof(*seg))
+}
+
+// addRedoHandles adds a segment to the list of segments of redo log handles and
+// returns the new list.
+func addRedoHandles(seg *redoSegment) []*redoSegment {
+	old := rHandles.Load().([]*redoSegment)
+	segs := make([]*redoSegment, len(old)+1)
+	copy(segs, old)
+	segs[len(old)] = seg
+	rHandles.Store(segs)
+	return segs
+}
+
+// growRedoHandles adds a segment of redo log handles, unless the maximum number
+// of handles has been reached. The new segment is initialized and persisted
+// before it is linked to the last segment, so a crash leaves either no new
+// segment or a fully initialized one.
+func growRedoHandles() bool {
+	segs := rHandles.Load().([]*redoSegment)
+	n := len(segs) * logNum
+	if max := atomic.LoadInt64(&maxRedoHandles); max > 0 && int64(n) >= max {
+		return false
+	}
+	seg := pnew(redoSegment)
+	initRedoSegment(seg, n)
+	last := segs[len(segs)-1]
+	last.next = seg
+	runtime.PersistRange(unsafe.Pointer(&last.next), ptrSize)
+	addRedoHandles(seg)
+	return true
+}
+
+// redoHandle returns the redo log handle at index 'i'
+func redoHandle(i int) *redoTx {
+	segs := rHandles.Load().([]*redoSegment)
+	return segs[i/logNum].logPtr[i%logNum]
+}
+
 func _initRedoTx(size, index int) *redoTx {
 	tx := pnew(redoTx)
 	tx.nEntry = size
@@ -141,6 +391,7 @@ func _initRedoTx(size, index int) *redoTx {
 	tx.wlocks = make([]*sync.RWMutex, 0, 0)
 	tx.rlocks = make([]*sync.RWMutex, 0, 0)
 	tx.storeSliceHdr = make([]pair, 0, 0)
+	tx.rawEntries = make([]int, 0, 0)
 	return tx
 }
 
@@ -149,16 +400,47 @@ func NewRedoTx() TX {
 		log.Fatal("redo log not correctly initialized!")
 	}
 	index := redoArray.nextAvailable()
-	return headerPtr.logPtr[index]
+	return redoHandle(index)
+}
+
+// TryNewRedoTx returns a redo transaction handle if one is available, and
+// returns ErrNoHandle otherwise. It never blocks.
+func TryNewRedoTx() (TX, error) {
+	if headerPtr == nil || headerPtr.magic != magic {
+		log.Fatal("redo log not correctly initialized!")
+	}
+	index := redoArray.tryNextAvailable()
+	if index < 0 {
+		return nil, ErrNoHandle
+	}
+	return redoHandle(index), nil
+}
+
+// NewRedoTxTimeout returns a redo transaction handle, waiting for up to
+// 'timeout' for one to be released if none is available. It returns
+// ErrNoHandle if no handle was available within that time.
+func NewRedoTxTimeout(timeout time.Duration) (TX, error) {
+	if headerPtr == nil || headerPtr.magic != magic {
+		log.Fatal("redo log not correctly initialized!")
+	}
+	index := redoArray.nextAvailableTimeout(timeout)
+	if index < 0 {
+		return nil, ErrNoHandle
+	}
+	return redoHandle(index), nil
 }
 
 func releaseRedoTx(t *redoTx) {
+	t.waitApplied()
 	t.abort()
 	redoArray.clearBit(t.index)
 }
 
 func (t *redoTx) ReadLog(intf ...interface{}) (retVal interface{}) {
 	if len(intf) == 2 {
+		if isMap(intf[0]) {
+			return t.readMapElem(intf[0], intf[1])
+		}
 		return t.readSliceElem(intf[0], intf[1].(int))
 	} else if len(intf) == 3 {
 		return t.readSlice(intf[0], intf[1].(int), intf[2].(int))
@@ -167,38 +449,23 @@ func (t *redoTx) ReadLog(intf ...interface{}) (retVal interface{}) {
 	}
 	ptrV := reflect.ValueOf(intf[0])
 	switch ptrV.Kind() {
+	case reflect.UnsafePointer:
+		// Raw read of data logged through Log3(). Returns the address where
+		// the latest copy of the data is staged.
+		retVal = t.readLogRaw(unsafe.Pointer(ptrV.Pointer()))
 	case reflect.Ptr:
 		oldVal := reflect.Indirect(ptrV)
-		var logData reflect.Value
-		if oldVal.Kind() == reflect.Struct {
-			// construct struct by reading each field from log
-			typ := oldVal.Type()
-			retStructPtr := reflect.New(typ)
-			retStruct := retStructPtr.Elem()
-			for i := 0; i < oldVal.NumField(); i++ {
-				structFieldPtr := oldVal.Field(i).Addr()
-				structFieldTyp := typ.Field(i).Type
-				if structFieldTyp.Kind() == reflect.Struct {
-					// Handle nested struct
-					v1 := t.ReadLog(structFieldPtr.Interface())
-					logData = reflect.ValueOf(v1)
-				} else {
-					logData = t.readLogEntry(structFieldPtr.Pointer(),
-						structFieldTyp)
-				}
-				if retStruct.Field(i).CanSet() {
-					retStruct.Field(i).Set(logData) // populate struct field
-				} else {
-					log.Fatal("[redoTx] ReadLog: Cannot read struct with " +
-						"unexported field")
-				}
-			}
-			retVal = retStruct.Interface()
-		} else if oldVal.Kind() == reflect.Invalid {
+		if oldVal.Kind() == reflect.Invalid {
 			// Do nothing.
 		} else {
 			typ := oldVal.Type()
-			logData = t.readLogEntry(ptrV.Pointer(), typ)
+			if !t.overlaps(ptrV.Pointer(), typ.Size()) {
+				// Read through the updates of deferred transactions which
+				// are not applied yet, if any.
+				retVal = readThroughPtr(ptrV)
+				break
+			}
+			logData := t.readLogEntry(ptrV.Pointer(), typ)
 			retVal = logData.Interface()
 		}
 	default:
@@ -208,16 +475,169 @@ func (t *redoTx) ReadLog(intf ...interface{}) (retVal interface{}) {
 }
 
 func (t *redoTx) readLogEntry(ptr uintptr, typ reflect.Type) (v reflect.Value) {
-	tail, ok := t.m[unsafe.Pointer(ptr)]
-	if !ok {
-		dataPtr := reflect.NewAt(typ, unsafe.Pointer(ptr))
-		v = reflect.Indirect(dataPtr)
-		// TODO: Data was not stored in redo log before. Should we log now?
-		return v
+	return t.readLogValue(ptr, typ, nil)
+}
+
+// readLogValue returns the latest value of the data of type 'typ' at 'ptr'.
+// Structs and arrays with pointers are constructed by reading each field or
+// element from the log, so that updates logged for any part of them are seen,
+// unless no part of an array was logged separately. 'outer' holds the indices
+// of the log entries which store the whole of an enclosing struct or array.
+func (t *redoTx) readLogValue(ptr uintptr, typ reflect.Type,
+	outer []int) reflect.Value {
+	kind := typ.Kind()
+	if kind != reflect.Struct && kind != reflect.Array {
+		// If data was not stored in redo log before, logAddr returns ptr
+		// itself. TODO: Should we log now?
+		logDataPtr := reflect.NewAt(typ, t.logAddr(ptr, typ.Size(), outer))
+		return reflect.Indirect(logDataPtr)
+	}
+	size := typ.Size()
+	if !hasPointers(typ) {
+		// The data is copied as a whole, and the parts of it found in the
+		// log are copied over it in the order they were logged.
+		retPtr := reflect.New(typ)
+		buf := (*[maxInt]byte)(unsafe.Pointer(retPtr.Pointer()))[:size:size]
+		copy(buf, (*[maxInt]byte)(unsafe.Pointer(ptr))[:size:size])
+		t.copyStaged(buf, ptr)
+		return retPtr.Elem()
+	}
+	if kind == reflect.Array && !t.splitLogged(ptr, size) {
+		// No part of the array was logged separately
+		return reflect.Indirect(reflect.NewAt(typ, t.logAddr(ptr, size, outer)))
+	}
+	if tail, ok := t.m[unsafe.Pointer(ptr)]; ok &&
+		uintptr(t.log[tail].size) >= size {
+		outer = append(outer, tail)
+	}
+	retPtr := reflect.New(typ)
+	retVal := retPtr.Elem()
+	if kind == reflect.Struct {
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			v := t.readLogValue(ptr+f.Offset, f.Type, outer)
+			structField(retVal, i).Set(v) // populate struct field
+		}
+	} else {
+		elemTyp := typ.Elem()
+		for i := 0; i < typ.Len(); i++ {
+			elemPtr := ptr + uintptr(i)*elemTyp.Size()
+			retVal.Index(i).Set(t.readLogValue(elemPtr, elemTyp, outer))
+		}
+	}
+	return retVal
+}
+
+// splitLogged returns true if a log entry holds some, but not all, of the
+// 'size' bytes starting at 'ptr'.
+func (t *redoTx) splitLogged(ptr, size uintptr) bool {
+	end := ptr + size
+	for i := 0; i < t.tail; i++ {
+		e := &t.log[i]
+		start := uintptr(e.ptr)
+		eEnd := start + uintptr(e.size)
+		if start < end && eEnd > ptr && (start > ptr || eEnd < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLogRaw returns the address at which the latest copy of data at 'ptr' is
+// found. If 'ptr' was not logged before, 'ptr' itself is returned.
+func (t *redoTx) readLogRaw(ptr unsafe.Pointer) unsafe.Pointer {
+	return t.logAddr(uintptr(ptr), 1, nil)
+}
+
+// logAddr returns the address at which the latest copy of the 'size' bytes
+// starting at 'ptr' is stored. The log entry for the exact address 'ptr', the
+// ranges containing all the bytes, and the entries in 'outer' are considered,
+// and the entry which was logged last is used. Returns 'ptr' if the data was
+// not logged before.
+func (t *redoTx) logAddr(ptr, size uintptr, outer []int) unsafe.Pointer {
+	addr := unsafe.Pointer(ptr)
+	tail, ok := t.m[addr]
+	if ok && uintptr(t.log[tail].size) >= size {
+		addr = t.log[tail].data
+	} else {
+		tail = -1
+	}
+	for _, i := range outer {
+		if i > tail {
+			tail = i
+			addr = unsafe.Pointer(uintptr(t.log[i].data) +
+				(ptr - uintptr(t.log[i].ptr)))
+		}
+	}
+	for _, i := range t.rawEntries {
+		e := &t.log[i]
+		start := uintptr(e.ptr)
+		if i > tail && ptr >= start && ptr+size <= start+uintptr(e.size) {
+			tail = i
+			addr = unsafe.Pointer(uintptr(e.data) + (ptr - start))
+		}
+	}
+	return addr
+}
+
+// isMap returns true if 'intf' is a map or a pointer to a map
+func isMap(intf interface{}) bool {
+	typ := reflect.TypeOf(intf)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ != nil && typ.Kind() == reflect.Map
+}
+
+// readMapElem returns the latest value stored for 'key' in the map 'mapIntf'.
+// If a pointer to the map is passed, the map itself is read from the log first.
+// If the map stores pointers, the latest value of the data pointed to by the
+// map element is returned.
+func (t *redoTx) readMapElem(mapIntf interface{}, key interface{}) interface{} {
+	mV := reflect.ValueOf(mapIntf)
+	if mV.Kind() == reflect.Ptr {
+		mV = t.readLogEntry(mV.Pointer(), mV.Type().Elem())
+	}
+	elemTyp := mV.Type().Elem()
+	v := mV.MapIndex(reflect.ValueOf(key))
+	if !v.IsValid() {
+		v = reflect.Zero(elemTyp)
+	}
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		return t.ReadLog(v.Interface())
+	}
+	return v.Interface()
+}
+
+// syncRawEntries copies the data stored in log entry 'tail' to the overlapping
+// parts of any range logged after it. This is needed when an entry is updated
+// in-place in the log, so that the entry logged last for each address always
+// has the latest data.
+func (t *redoTx) syncRawEntries(tail int) {
+	e := &t.log[tail]
+	start := uintptr(e.ptr)
+	end := start + uintptr(e.size)
+	for _, i := range t.rawEntries {
+		if i <= tail {
+			continue
+		}
+		r := &t.log[i]
+		lo := uintptr(r.ptr)
+		hi := lo + uintptr(r.size)
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo >= hi {
+			continue
+		}
+		rData := (*[maxInt]byte)(unsafe.Pointer(uintptr(r.data) + lo -
+			uintptr(r.ptr)))
+		eData := (*[maxInt]byte)(unsafe.Pointer(uintptr(e.data) + lo - start))
+		copy(rData[:hi-lo], eData[:hi-lo])
 	}
-	logDataPtr := reflect.NewAt(typ, t.log[tail].data)
-	v = reflect.Indirect(logDataPtr)
-	return v
 }
 
 func (t *redoTx) readSliceElem(slicePtr interface{}, index int) interface{} {
@@ -229,7 +649,7 @@ func (t *redoTx) readSliceElem(slicePtr interface{}, index int) interface{} {
 		logData := t.readLogEntry(ptrV.Pointer(), sTyp) // read sliceheader 1st
 		v := (*value)(unsafe.Pointer(&logData))
 		newShdr := (*sliceHeader)(v.ptr)
-		if index > newShdr.len {
+		if index < 0 || index >= newShdr.len {
 			log.Fatal("[redoTx] readSliceElem: Index out of bounds")
 		}
 		elemType := sTyp.Elem() // type of elements in slice
@@ -289,19 +709,228 @@ func checkDataTypes(newV reflect.Value, v1 reflect.Value) (err error) {
 	return err
 }
 
+// Log3 stages 'size' bytes starting at 'src' in a buffer owned by the redo log.
+// The buffer is initialized with the current contents of 'src', overlaid with
+// any updates already staged in the log for parts of the range. The address of
+// the buffer can be read using ReadLog(src), and any update written to it is
+// copied to 'src' when the transaction commits. E.g.:
+//
+//	tx.Log3(unsafe.Pointer(&s), unsafe.Sizeof(s))
+//	buf := (*S)(tx.ReadLog(unsafe.Pointer(&s)).(unsafe.Pointer))
+//	buf.i = 10 // s.i = 10 after tx.End()
+//
+// Data without pointers is staged in the log arena. If the garbage collector
+// finds pointers in the range, it is staged in a typed persistent object
+// instead, in which each word holding a pointer or nil when Log3 is called is
+// typed as a pointer. Pointers stored in these words of the buffer are then
+// seen by the garbage collector and swizzled by recovery. Other words of the
+// buffer must not be used to store pointers.
 func (t *redoTx) Log3(src unsafe.Pointer, size uintptr) error {
-	log.Fatal("Not implemented")
+	if size == 0 {
+		return nil
+	}
+	if err := t.checkNone(uintptr(src)); err != nil {
+		return err
+	}
+	if err := t.lockRange(src, size); err != nil {
+		return err
+	}
+	tail, ok := t.m[src]
+	if ok && !t.frozen(tail) && uintptr(t.log[tail].size) >= size {
+		// Data already staged in the log
+		return nil
+	}
+
+	t.ptrArray = runtime.CollectPtrs(uintptr(src), int(size), t.ptrArray[:0])
+	noPtrs := len(t.ptrArray) == 0
+	var buf unsafe.Pointer
+	if noPtrs {
+		buf = t.arenaAlloc(size)
+	} else {
+		buf = t.typedAlloc(src, size)
+	}
+	t.ptrArray = t.ptrArray[:0]
+	bufSlc := (*[maxInt]byte)(buf)[:size:size]
+	srcSlc := (*[maxInt]byte)(src)[:size:size]
+	copy(bufSlc, srcSlc)
+	// Parts of the range may have been logged before, starting at 'src' or
+	// elsewhere. Retain the updates already made to the staged copies.
+	t.copyStaged(bufSlc, uintptr(src))
+	if !ok || t.frozen(tail) {
+		tail = t.entryIndex(src)
+	}
+	t.setEntry(tail, src, buf, int(size), noPtrs)
+	t.rawEntries = append(t.rawEntries, tail)
+	if ok {
+		t.syncRawEntries(tail)
+	}
 	return nil
 }
 
+// stageTypes caches the types built by typedAlloc, keyed by their layout.
+var stageTypes sync.Map
+
+// typedAlloc returns the address of 'size' bytes in a new persistent object,
+// laid out like the range starting at 'src'. Words of the range that hold nil
+// or one of the pointers in t.ptrArray are typed as pointers in the object.
+// Contents of 'src' are not copied.
+func (t *redoTx) typedAlloc(src unsafe.Pointer, size uintptr) unsafe.Pointer {
+	ptrs := make(map[unsafe.Pointer]bool, len(t.ptrArray))
+	for _, p := range t.ptrArray {
+		ptrs[p] = true
+	}
+	// The layout is a string of 'p' and 'w' for each pointer and non-pointer
+	// word, starting at the word-aligned address below 'src'.
+	lead := uintptr(src) & (ptrSize - 1)
+	start := uintptr(src) - lead
+	words := (lead + size + ptrSize - 1) / ptrSize
+	layout := make([]byte, words)
+	for i := range layout {
+		layout[i] = 'w'
+		if i == 0 && lead != 0 || uintptr(i+1)*ptrSize > lead+size {
+			// Partial words cannot hold a pointer
+			continue
+		}
+		w := *(*unsafe.Pointer)(unsafe.Pointer(start + uintptr(i)*ptrSize))
+		if w == nil || ptrs[w] {
+			layout[i] = 'p'
+		}
+	}
+	key := string(layout)
+	typ, ok := stageTypes.Load(key)
+	if !ok {
+		typ, _ = stageTypes.LoadOrStore(key, stageType(layout))
+	}
+	obj := reflect.PNew(typ.(reflect.Type))
+	return unsafe.Pointer(obj.Pointer() + lead)
+}
+
+// stageType builds a struct type with the word layout given by 'layout'.
+func stageType(layout []byte) reflect.Type {
+	var fields []reflect.StructField
+	ptrType := reflect.TypeOf(unsafe.Pointer(nil))
+	wordType := reflect.TypeOf(uintptr(0))
+	for i := 0; i < len(layout); {
+		j := i + 1
+		for j < len(layout) && layout[j] == layout[i] {
+			j++
+		}
+		elem := wordType
+		if layout[i] == 'p' {
+			elem = ptrType
+		}
+		fields = append(fields, reflect.StructField{
+			Name: "F" + strconv.Itoa(len(fields)),
+			Type: reflect.ArrayOf(j-i, elem),
+		})
+		i = j
+	}
+	return reflect.StructOf(fields)
+}
+
+// copyStaged copies the data staged in the log for any part of the len(dst)
+// bytes starting at 'start' to 'dst'. Entries are visited in the order they were
+// logged, so the data of the entry logged last for each byte is copied last.
+// syncRawEntries keeps this data the latest even if an earlier entry is updated
+// in-place.
+func (t *redoTx) copyStaged(dst []byte, start uintptr) {
+	end := start + uintptr(len(dst))
+	for i := 0; i < t.tail; i++ {
+		e := &t.log[i]
+		lo := uintptr(e.ptr)
+		hi := lo + uintptr(e.size)
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo >= hi {
+			continue
+		}
+		eData := (*[maxInt]byte)(unsafe.Pointer(uintptr(e.data) + lo -
+			uintptr(e.ptr)))
+		copy(dst[lo-start:hi-start], eData[:hi-lo])
+	}
+}
+
+// LogRange stages new values for a range of elements of a slice, without the
+// need to create a new copy of the whole slice. 'slice' is the slice, or a
+// pointer to the slice, to be updated. 'elems' is a slice of the same type
+// holding the new values of the elements starting at index 'start'. If a
+// pointer to the slice is passed, the sliceheader is read from the log, so
+// that a slice resized within this transaction can be updated.
+func (t *redoTx) LogRange(slice interface{}, start int, elems interface{}) (
+	err error) {
+	sV := reflect.ValueOf(slice)
+	if sV.Kind() == reflect.Ptr && sV.Type().Elem().Kind() == reflect.Slice {
+		sV = t.readLogEntry(sV.Pointer(), sV.Type().Elem())
+	}
+	eV := reflect.ValueOf(elems)
+	if err = checkRange(sV, start, eV); err != nil {
+		return err
+	}
+	n := eV.Len()
+	if n == 0 {
+		return nil
+	}
+	dst := sV.Index(start).UnsafeAddr()
+	if err = t.checkNone(dst); err != nil {
+		return err
+	}
+	if !runtime.InPmem(dst) {
+		err = errors.New("[redoTx] LogRange: Updates to data in volatile " +
+			"memory can be lost")
+	}
+	size := uintptr(n) * sV.Type().Elem().Size()
+	if lockErr := t.lockRange(unsafe.Pointer(dst), size); lockErr != nil {
+		return lockErr
+	}
+	var logData unsafe.Pointer
+	noPtrs := !hasPointers(sV.Type().Elem())
+	if noPtrs {
+		logData = t.arenaAlloc(size)
+		logSlc := (*[maxInt]byte)(logData)[:size:size]
+		elemSlc := (*[maxInt]byte)(unsafe.Pointer(eV.Pointer()))[:size:size]
+		copy(logSlc, elemSlc)
+	} else {
+		newV := reflect.PMakeSlice(sV.Type(), n, n)
+		reflect.Copy(newV, eV)
+		logData = unsafe.Pointer(newV.Pointer())
+	}
+	tail := t.newEntry()
+	t.setEntry(tail, unsafe.Pointer(dst), logData, int(size), noPtrs)
+	t.rawEntries = append(t.rawEntries, tail)
+	return err
+}
+
+// Log2 stages a copy of 'size' bytes from 'src' to 'dst' in the log. The data is
+// read from 'src' when Log2 is called, including any updates already staged for
+// it, and is copied to 'dst' when the transaction commits. 'src' and 'dst' may
+// overlap. The data is staged using Log3().
 func (t *redoTx) Log2(src, dst unsafe.Pointer, size uintptr) error {
-	log.Fatal("Not implemented")
+	if size == 0 {
+		return nil
+	}
+	// Read the source before staging 'dst', which may overlap it
+	data := make([]byte, size)
+	copy(data, (*[maxInt]byte)(src)[:size:size])
+	t.copyStaged(data, uintptr(src))
+	if err := t.Log3(dst, size); err != nil {
+		return err
+	}
+	tail := t.m[dst]
+	copy((*[maxInt]byte)(t.log[tail].data)[:size:size], data)
+	t.syncRawEntries(tail)
 	return nil
 }
 
-// Caveat: With the current implementation, Redo Log doesn't support logging
-// structs with unexported slice, struct, interface members. Individual fields
-// of struct can be logged.
+// When a struct is logged, each of its fields is stored separately in the log.
+// Unexported fields, including nested structs and slices, are logged as well.
+// A slice field is logged as a sliceheader, like Log(&slice, newSlice): when
+// the transaction commits, the field is set to the new slice, whose backing
+// array is in persistent memory. The elements of the old backing array are not
+// updated, so other slices sharing it do not see the new values.
 func (t *redoTx) Log(intf ...interface{}) (err error) {
 	if len(intf) != 2 {
 		return errors.New("[redoTx] Log: Incorrectly called. Correct usage: " +
@@ -316,14 +945,23 @@ func (t *redoTx) Log(intf ...interface{}) (err error) {
 				"not of the same type")
 		}
 
-		// Each slice element is stored separately in log
-		var vLen int
-		if v1.Len() < v2.Len() {
-			vLen = v1.Len()
-		} else {
-			vLen = v2.Len()
+		if v1.Len() != v2.Len() {
+			// The sliceheader is not known here, so the slice can't be resized
+			return errors.New("Log Error. Slice values passed to Log() are " +
+				"not of the same length. Use Log(&slice, newSlice) to resize " +
+				"a slice")
+		}
+
+		if err = t.checkNone(v1.Pointer()); err != nil {
+			return err
 		}
-		for i := 0; i < vLen; i++ {
+		size := uintptr(v1.Len()) * v1.Type().Elem().Size()
+		if err = t.lockRange(unsafe.Pointer(v1.Pointer()), size); err != nil {
+			return err
+		}
+
+		// Each slice element is stored separately in log
+		for i := 0; i < v1.Len(); i++ {
 			elemNewVal := v2.Index(i)
 			elemPtr := v1.Index(i).Addr()
 			t.writeLogEntry(elemPtr.Pointer(), elemNewVal, elemNewVal.Type())
@@ -334,33 +972,15 @@ func (t *redoTx) Log(intf ...interface{}) (err error) {
 		if err != nil {
 			return err
 		}
+		if err = t.checkNone(v1.Pointer()); err != nil {
+			return err
+		}
+		err = t.lockRange(unsafe.Pointer(v1.Pointer()), oldType.Size())
+		if err != nil {
+			return err
+		}
 		if v2.Kind() == reflect.Struct {
-			// Each struct field is stored separately in log
-			oldV := reflect.Indirect(v1)
-			for i := 0; i < v2.NumField(); i++ {
-				newVal := v2.Field(i)
-				oldVal := oldV.Field(i)
-				oldType = oldVal.Type()
-				ptrOrig := oldVal.Addr()
-				if newVal.Kind() == reflect.Struct {
-					if !newVal.CanInterface() {
-						log.Fatal("[redoTx] Log: Cannot log unexported struct" +
-							"member variable")
-					}
-					err = t.Log(ptrOrig.Interface(), newVal.Interface())
-				} else if newVal.Kind() == reflect.Slice {
-					if !newVal.CanInterface() {
-						log.Fatal("[redoTx] Log: Cannot log unexported slice" +
-							"member variable")
-					}
-					err = t.Log(oldVal.Interface(), newVal.Interface())
-				} else {
-					err = t.writeLogEntry(ptrOrig.Pointer(), newVal, oldType)
-				}
-				if err != nil {
-					return err
-				}
-			}
+			err = t.logStruct(reflect.Indirect(v1), v2)
 		} else {
 			err = t.writeLogEntry(v1.Pointer(), v2, oldType)
 		}
@@ -375,73 +995,243 @@ func (t *redoTx) Log(intf ...interface{}) (err error) {
 	return err
 }
 
+// logStruct stores each field of the struct 'newV' separately in the log, as
+// the new value of the corresponding field of the struct 'oldV'. 'oldV' must be
+// addressable.
+func (t *redoTx) logStruct(oldV, newV reflect.Value) (err error) {
+	newV = addressable(newV)
+	for i := 0; i < newV.NumField(); i++ {
+		newVal := structField(newV, i)
+		oldVal := structField(oldV, i)
+		if newVal.Kind() == reflect.Struct {
+			err = t.logStruct(oldVal, newVal)
+		} else {
+			err = t.writeLogEntry(oldVal.UnsafeAddr(), newVal, oldVal.Type())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addressable returns 'v' if it is addressable, else an addressable copy of it.
+func addressable(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v
+	}
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	return c
+}
+
+// structField returns the i'th field of the addressable struct 'v'. The field
+// is accessed through its address, so that it can be read and set using
+// reflection even if it is unexported.
+func structField(v reflect.Value, i int) reflect.Value {
+	f := v.Field(i)
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+}
+
 func (t *redoTx) writeLogEntry(ptr uintptr, data reflect.Value,
 	typ reflect.Type) error {
 	size := int(typ.Size())
-	var logDataPtr reflect.Value
-	logDataPtr = reflect.PNew(typ)
-	if data.Kind() == reflect.Invalid {
-		// Do nothing, data has <nil> value
-	} else if data.CanInterface() {
-		reflect.Indirect(logDataPtr).Set(data)
-	} else { // To log unexported fields of struct
-		switch data.Kind() {
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
-			reflect.Int64:
-			reflect.Indirect(logDataPtr).SetInt(data.Int())
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
-			reflect.Uint64, reflect.Uintptr:
-			reflect.Indirect(logDataPtr).SetUint(data.Uint())
-		case reflect.Float32, reflect.Float64:
-			reflect.Indirect(logDataPtr).SetFloat(data.Float())
-		case reflect.Bool:
-			reflect.Indirect(logDataPtr).SetBool(data.Bool())
-		case reflect.Complex64, reflect.Complex128:
-			reflect.Indirect(logDataPtr).SetComplex(data.Complex())
-		case reflect.String:
-			reflect.Indirect(logDataPtr).SetString(data.String())
-		case reflect.Ptr, reflect.UnsafePointer:
-			// Go only allows setting a pointer as unsafe.Pointer, so logDataPtr
-			// has to be reallocated with new type as unsafe.Pointer
-			ptrData := unsafe.Pointer(data.Pointer())
-			logDataPtr = reflect.PNew(reflect.TypeOf(ptrData))
-			reflect.Indirect(logDataPtr).SetPointer(ptrData)
-		default:
-			log.Fatalf("[redoTx] Log: Cannot log unexported data of kind: ",
-				data.Kind(), "type: ", typ)
-		}
+	if data.Kind() == reflect.Slice && runtime.InPmem(ptr) {
+		// Make sure the new backing array of the slice is in persistent memory
+		// too, so that it can be persisted along with the sliceheader.
+		data = pmemSlice(data)
 	}
+	i, logged := t.m[unsafe.Pointer(ptr)]
+	logged = logged && !t.frozen(i)
+	tail := t.entryIndex(unsafe.Pointer(ptr))
 
-	// Check if write to this addr already stored in log by checking in map.
-	// If yes, update value in-place in log. Else add new entry to log.
-	tail, ok := t.m[unsafe.Pointer(ptr)]
-	if !ok {
-		tail = t.tail
-		t.m[unsafe.Pointer(ptr)] = t.tail
-
-		// Update log offset in header.
-		t.tail++
-		if t.tail >= t.nEntry { // Expand log if necessary
-			newE := 2 * t.nEntry
-			newLog := pmake([]entry, newE)
-			copy(newLog, t.log)
-			t.log = newLog
-			t.nEntry = newE
-		}
+	// Data without pointers is stored in the log arena. If this address was
+	// logged in the arena before, the logged copy is updated in-place. Data
+	// with pointers is copied to a new persistent object with type info, so
+	// that the GC finds the pointers and the runtime can swizzle them.
+	noPtrs := !hasPointers(typ)
+	var logData unsafe.Pointer
+	if noPtrs && logged && t.log[tail].size >= size &&
+		t.inArena(t.log[tail].data) {
+		logData = t.log[tail].data
+		size = t.log[tail].size
+	} else if noPtrs {
+		logData = t.arenaAlloc(typ.Size())
+	} else {
+		logData = unsafe.Pointer(reflect.PNew(typ).Pointer())
+	}
+	logVal := reflect.NewAt(typ, logData).Elem()
+	if data.Kind() == reflect.Invalid {
+		// data has <nil> value
+		logVal.Set(reflect.Zero(typ))
+	} else {
+		// Unexported struct fields are read through their address by
+		// logStruct(), so data can always be used as an interface.
+		logVal.Set(data)
 	}
 
 	// Update log to have addr of original data, addr of new copy & size of data
-	t.log[tail].ptr = unsafe.Pointer(ptr)
-	t.log[tail].data = unsafe.Pointer(logDataPtr.Pointer())
-	t.log[tail].size = size
-	if data.Kind() == reflect.Slice {
+	t.setEntry(tail, unsafe.Pointer(ptr), logData, size, noPtrs)
+	if data.Kind() == reflect.Slice && !logged {
 		// ptr to sliceHeader was passed for logging, so need to persist
 		// new slice too on tx complete. This will be used in t.commit()
 		t.storeSliceHdr = append(t.storeSliceHdr, pair{tail, int(data.Type().Elem().Size())})
 	}
+	if logged {
+		t.syncRawEntries(tail)
+	}
 	return nil
 }
 
+// setEntry updates the log entry at index 'tail'. Entries pointing to data in
+// the log arena are written using non-temporal stores, so that they need not be
+// flushed separately. This skips the GC write barriers, which is safe as the
+// arena and the data being updated are both reachable from elsewhere. Other
+// entries may hold the only reference to the logged copy of data, so these are
+// written using regular stores.
+func (t *redoTx) setEntry(tail int, ptr, data unsafe.Pointer, size int,
+	inArena bool) {
+	if !inArena {
+		t.log[tail].ptr = ptr
+		t.log[tail].data = data
+		t.log[tail].size = size
+		t.regEntries = append(t.regEntries, tail)
+		return
+	}
+	e := &t.entryBuf
+	e.ptr = ptr
+	e.data = data
+	e.size = size
+	t.ntStores = true
+	movnt(unsafe.Pointer(&t.log[tail]), unsafe.Pointer(e), unsafe.Sizeof(*e))
+}
+
+// arenaAlloc returns the address of 'size' bytes in the log arena.
+func (t *redoTx) arenaAlloc(size uintptr) unsafe.Pointer {
+	// Keep data 8-byte aligned, so that it can be copied using movnt
+	sz := int((size + 7) &^ 7)
+	if sz == 0 {
+		sz = 8
+	}
+	if t.first == nil {
+		// First use of this handle. Allocate the arena.
+		newLog := pnew(uLogData)
+		newLog.log = pmake([]byte, rLogInitSize)
+		runtime.PersistRange(unsafe.Pointer(newLog), unsafe.Sizeof(*newLog))
+		t.first = newLog
+		runtime.PersistRange(unsafe.Pointer(&t.first), ptrSize)
+		t.curr = newLog
+		t.dataTail = 0
+	}
+	if t.dataTail+sz > len(t.curr.log) {
+		t.increaseArenaSize(sz)
+	}
+	p := unsafe.Pointer(&t.curr.log[t.dataTail])
+	t.dataTail += sz
+	return p
+}
+
+// increaseArenaSize links a log arena buffer of size at least toAdd bytes to
+// the existing linked list of arena buffers. Any existing buffer that has
+// sufficient capacity is reused.
+func (t *redoTx) increaseArenaSize(toAdd int) {
+	uData := t.curr
+	if uData.next != nil && cap(uData.next.log) >= toAdd {
+		t.curr = uData.next
+		t.dataTail = 0
+		return
+	}
+
+	newCap := cap(uData.log) * 2
+	if toAdd > newCap {
+		// make sure newCap is a multiple of cacheline size
+		newCap = cacheSize * ((toAdd + cacheSize - 1) / cacheSize)
+	}
+	newLog := pnew(uLogData)
+	newLog.log = pmake([]byte, newCap)
+	runtime.PersistRange(unsafe.Pointer(newLog), unsafe.Sizeof(*newLog))
+	uData.next = newLog
+	runtime.PersistRange(unsafe.Pointer(&uData.next), ptrSize)
+	t.curr = newLog
+	t.dataTail = 0
+}
+
+// inArena returns true if 'p' points to data in the log arena.
+func (t *redoTx) inArena(p unsafe.Pointer) bool {
+	for uData := t.first; uData != nil; uData = uData.next {
+		start := uintptr(unsafe.Pointer(&uData.log[0]))
+		if uintptr(p) >= start && uintptr(p) < start+uintptr(len(uData.log)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPointers returns true if data of type 'typ' contains any pointers.
+func hasPointers(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32,
+		reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Array:
+		return typ.Len() > 0 && hasPointers(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if hasPointers(typ.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// pmemSlice returns a slice with the same contents as 's', whose backing array
+// is in persistent memory. A new backing array is allocated only if that of 's'
+// is in volatile memory.
+func pmemSlice(s reflect.Value) reflect.Value {
+	if s.Pointer() == 0 || runtime.InPmem(s.Pointer()) || !s.CanInterface() {
+		return s
+	}
+	newS := reflect.PMakeSlice(s.Type(), s.Len(), s.Cap())
+	reflect.Copy(newS, s)
+	return newS
+}
+
+// entryIndex returns the index of the log entry which stores updates to 'ptr'.
+func (t *redoTx) entryIndex(ptr unsafe.Pointer) int {
+	// Check if write to this addr already stored in log by checking in map.
+	// If yes, update value in-place in log. Else add new entry to log. An
+	// entry which is part of a checkpoint is not updated, and a new entry is
+	// added instead.
+	tail, ok := t.m[ptr]
+	if !ok || t.frozen(tail) {
+		tail = t.newEntry()
+		t.m[ptr] = tail
+	}
+	return tail
+}
+
+// newEntry adds a new entry at the tail of the log and returns its index.
+func (t *redoTx) newEntry() int {
+	tail := t.tail
+
+	// Update log offset in header.
+	t.tail++
+	if t.tail >= t.nEntry { // Expand log if necessary
+		newE := 2 * t.nEntry
+		newLog := pmake([]entry, newE)
+		copy(newLog, t.log)
+		t.log = newLog
+		t.nEntry = newE
+		t.logGrown = true
+	}
+	return tail
+}
+
 /* Exec function receives a variable number of interfaces as its arguments.
  * Usage: Exec(fn_name, fn_arg1, fn_arg2, ...)
  * Function fn_name() should not return anything.
@@ -495,7 +1285,27 @@ func (t *redoTx) Exec(intf ...interface{}) (retVal []reflect.Value, err error) {
 	return retVal, err
 }
 
-func (t *redoTx) Begin() error {
+// Begin starts a transaction. The durability level of the transaction can be
+// given as "sync", "deferred" or "none" when the outermost transaction begins.
+// Nested transactions have the durability level of the outermost transaction.
+func (t *redoTx) Begin(d ...Durability) error {
+	code, err := durabilityCode(d)
+	if err != nil {
+		return errors.New("[redoTx] " + err.Error())
+	}
+	// Wait for the updates of the last transaction to be applied, if it ended
+	// with deferred durability.
+	t.waitApplied()
+	if (t.name != nil || t.group != nil) && code != durSync {
+		return errors.New("[redoTx] Begin: A resumable or shared " +
+			"transaction must have sync durability")
+	}
+	if t.level == 0 {
+		t.durability = code
+	} else if len(d) > 0 && code != t.durability {
+		return errors.New("[redoTx] Begin: Durability level of a nested " +
+			"transaction must match the outermost transaction")
+	}
 	t.level++
 	return nil
 }
@@ -510,53 +1320,129 @@ func (t *redoTx) End() bool {
 	}
 	t.level--
 	if t.level == 0 {
+		if t.name != nil {
+			// A resumable transaction is only committed by Commit()
+			t.checkpoint()
+			return true
+		}
+		if t.group != nil {
+			// Updates of a shared transaction are committed when the
+			// parent transaction ends.
+			return true
+		}
+		if t.durability == durNone {
+			// Only data in volatile memory was logged, so nothing is
+			// persisted. The transaction is never marked committed, so
+			// recovery drops any part of the log found.
+			t.applyVolatile()
+			t.reset(t.tail)
+			return true
+		}
 		// Flush changes in log. Mark tx as committed. Call commit()
-		// to transfer changes to app data structures
-		for i := t.tail - 1; i >= 0; i-- {
-			runtime.PersistRange(t.log[i].data, uintptr(t.log[i].size))
-		}
-		runtime.PersistRange(unsafe.Pointer(&t.log[0]),
-			uintptr(t.tail*(int)(unsafe.Sizeof(t.log[0]))))
-		runtime.PersistRange(unsafe.Pointer(t), unsafe.Sizeof(*t))
-		t.committed = true
-		runtime.PersistRange(unsafe.Pointer(&t.committed),
-			unsafe.Sizeof(t.committed))
-		t.commit(false)
+		// to transfer changes to app data structures. Each cacheline of the
+		// log is flushed only once, followed by a single fence.
+		t.insertLog()
+		if window, ok := groupCommitWindow(); ok {
+			groupCommit(&t.fs, t.markCommitted, window, t.ntStores)
+		} else {
+			t.fs.flushAndFence()
+			persist(t.markCommitted())
+		}
+		t.ntStores = false
+		if t.updatesVersioned() {
+			t.snapshotCommit()
+		} else if t.durability == durDeferred {
+			deferApply(t)
+		} else {
+			t.commit(false)
+		}
 		return true
 	}
 	return false
 }
 
-func (t *redoTx) RLock(m *sync.RWMutex) {
-	m.RLock()
-	t.rlocks = append(t.rlocks, m)
+func (t *redoTx) RLock(m *sync.RWMutex) error {
+	if !rLock(&t.rlocks, &t.wlocks, m) {
+		t.abort()
+		return ErrDeadlock
+	}
+	return nil
 }
 
-func (t *redoTx) WLock(m *sync.RWMutex) {
-	m.Lock()
-	t.wlocks = append(t.wlocks, m)
+func (t *redoTx) WLock(m *sync.RWMutex) error {
+	if !wLock(&t.rlocks, &t.wlocks, m) {
+		t.abort()
+		return ErrDeadlock
+	}
+	return nil
 }
 
-func (t *redoTx) Lock(m *sync.RWMutex) {
-	t.WLock(m)
+func (t *redoTx) Lock(m *sync.RWMutex) error {
+	return t.WLock(m)
 }
 
-func (t *redoTx) unLock() {
-	for i, m := range t.wlocks {
-		m.Unlock()
-		t.wlocks[i] = nil
+func (t *redoTx) LockAll(ms ...*sync.RWMutex) error {
+	if !lockAll(&t.rlocks, &t.wlocks, ms) {
+		t.abort()
+		return ErrDeadlock
+	}
+	return nil
+}
+
+// Read acquires the read locks in the range lock table covering 'size' bytes
+// starting at 'ptr'. It does nothing if range locking is disabled.
+func (t *redoTx) Read(ptr unsafe.Pointer, size uintptr) error {
+	if !rangeLock(&t.rlocks, &t.wlocks, ptr, size, false) {
+		t.abort()
+		return ErrDeadlock
 	}
-	t.wlocks = t.wlocks[:0]
-	for i, m := range t.rlocks {
-		m.RUnlock()
-		t.rlocks[i] = nil
+	return nil
+}
+
+// checkNone returns ErrVolatileOnly if the transaction has durability "none"
+// and 'ptr' is in persistent memory.
+func (t *redoTx) checkNone(ptr uintptr) error {
+	if t.durability == durNone && runtime.InPmem(ptr) {
+		return ErrVolatileOnly
 	}
-	t.rlocks = t.rlocks[:0]
+	return nil
+}
+
+// lockRange acquires the write locks in the range lock table covering 'size'
+// bytes starting at 'ptr'. It does nothing if range locking is disabled. It
+// returns ErrPrepared if the range is updated by a prepared transaction found
+// during recovery.
+func (t *redoTx) lockRange(ptr unsafe.Pointer, size uintptr) error {
+	if err := checkPrepared(ptr, size); err != nil {
+		return err
+	}
+	if t.trackWrites {
+		t.writeSet = append(t.writeSet, memRange{uintptr(ptr), size})
+	}
+	if !rangeLock(&t.rlocks, &t.wlocks, ptr, size, true) {
+		t.abort()
+		return ErrDeadlock
+	}
+	return nil
+}
+
+func (t *redoTx) unLock() {
+	unlockAll(&t.rlocks, &t.wlocks)
 }
 
 // Performs in-place updates of app data structures. Started again, if crashed
 // in between
 func (t *redoTx) commit(skipVolData bool) error {
+	t.applyLog(skipVolData)
+	return t.endCommit()
+}
+
+// applyLog copies the data in the log to the app data structures. Data without
+// pointers is copied from the log arena using non-temporal stores. Data with
+// pointers is copied using regular stores, so that the GC write barriers are
+// not skipped, and the updated cachelines are flushed once all updates are
+// done. A single fence orders both.
+func (t *redoTx) applyLog(skipVolData bool) {
 	j := 0
 	for i := 0; i < t.tail; i++ {
 		oldDataPtr := (*[maxInt]byte)(t.log[i].ptr)
@@ -565,28 +1451,92 @@ func (t *redoTx) commit(skipVolData bool) error {
 			// we drop updates to data in volatile memory
 			continue
 		}
-		logDataPtr := (*[maxInt]byte)(t.log[i].data)
-		oldData := oldDataPtr[:t.log[i].size:t.log[i].size]
-		logData := logDataPtr[:t.log[i].size:t.log[i].size]
-		copy(oldData, logData)
-		runtime.PersistRange(t.log[i].ptr, uintptr(t.log[i].size))
+		size := uintptr(t.log[i].size)
+		if t.inArena(t.log[i].data) {
+			movnt(t.log[i].ptr, t.log[i].data, size)
+		} else {
+			logDataPtr := (*[maxInt]byte)(t.log[i].data)
+			oldData := oldDataPtr[:size:size]
+			logData := logDataPtr[:size:size]
+			copy(oldData, logData)
+			t.fs.insert(uintptr(t.log[i].ptr), size)
+		}
 		if j < len(t.storeSliceHdr) && t.storeSliceHdr[j].first == i {
 			// ptr points to sliceHeader. So, need to persist the slice too
 			shdr := (*sliceHeader)(t.log[i].ptr)
-			runtime.PersistRange(shdr.data, uintptr(shdr.len*
+			t.fs.insert(uintptr(shdr.data), uintptr(shdr.len*
 				t.storeSliceHdr[j].second))
 			j++
 		}
 	}
-	t.committed = false
-	runtime.PersistRange(unsafe.Pointer(&t.committed),
-		unsafe.Sizeof(t.committed))
+	t.fs.flushAndFence()
+}
+
+// insertLog adds the data in the log, the log entries written using regular
+// stores and the handle to the cachelines to be flushed. Entries written using
+// non-temporal stores are only fenced.
+func (t *redoTx) insertLog() {
+	for i := t.tail - 1; i >= 0; i-- {
+		t.fs.insert(uintptr(t.log[i].data), uintptr(t.log[i].size))
+	}
+	entrySz := unsafe.Sizeof(t.log[0])
+	if t.logGrown {
+		t.fs.insert(uintptr(unsafe.Pointer(&t.log[0])),
+			uintptr(t.tail)*entrySz)
+	} else {
+		for _, i := range t.regEntries {
+			t.fs.insert(uintptr(unsafe.Pointer(&t.log[i])), entrySz)
+		}
+	}
+	t.regEntries = t.regEntries[:0]
+	t.logGrown = false
+	t.fs.insert(uintptr(unsafe.Pointer(t)), unsafe.Sizeof(*t))
+}
+
+// insertSlices adds the contents of the new slices logged in the entries from
+// index 'from' to the cachelines to be flushed. These are otherwise persisted
+// only when the log is applied.
+func (t *redoTx) insertSlices(from int) {
+	for _, p := range t.storeSliceHdr {
+		if p.first >= from {
+			shdr := (*sliceHeader)(t.log[p.first].data)
+			t.fs.insert(uintptr(shdr.data), uintptr(shdr.len*p.second))
+		}
+	}
+}
+
+// markCommitted marks the transaction as committed. It returns the range to be
+// persisted for this to be durable.
+func (t *redoTx) markCommitted() (unsafe.Pointer, uintptr) {
+	return t.setStatus(redoCommitted)
+}
+
+// setStatus sets the status of the transaction. It returns the range to be
+// persisted for this to be durable.
+func (t *redoTx) setStatus(status int) (unsafe.Pointer, uintptr) {
+	t.status = status
+	return unsafe.Pointer(&t.status), unsafe.Sizeof(t.status)
+}
+
+// endCommit marks the transaction as active once all updates are applied and
+// resets the log.
+func (t *redoTx) endCommit() error {
+	runtime.PersistRange(t.setStatus(redoActive))
 	t.reset(t.tail)
 	return nil
 }
 
-// Resets every entry in the log
+// Resets every entry in the log. A resumable transaction is instead rolled back
+// to its last checkpoint.
 func (t *redoTx) abort() error {
+	if t.group != nil {
+		// The whole shared transaction is rolled back when it ends
+		atomic.StoreInt32(&t.group.aborted, 1)
+	}
+	if t.name != nil {
+		t.rollback()
+		return nil
+	}
 	t.reset(t.tail)
 	return nil
 }
@@ -595,7 +1545,11 @@ func (t *redoTx) abort() error {
 func (t *redoTx) reset(sz int) {
 	defer t.unLock()
 	t.level = 0
-	t.m = make(map[unsafe.Pointer]int)
+	// Clear the map in-place, so that its memory is reused by the next
+	// transaction.
+	for k := range t.m {
+		delete(t.m, k)
+	}
 	t.log = t.log[:NumEntries] // reset to original size
 	t.nEntry = NumEntries
 	if sz > NumEntries {
@@ -607,5 +1561,12 @@ func (t *redoTx) reset(sz int) {
 		t.log[i].size = 0
 	}
 	t.tail = 0
-	t.storeSliceHdr = make([]pair, 0, 0)
+	t.storeSliceHdr = t.storeSliceHdr[:0]
+	t.rawEntries = t.rawEntries[:0]
+	t.writeSet = t.writeSet[:0]
+	t.curr = t.first
+	t.dataTail = 0
+	t.ntStores = false
+	t.regEntries = t.regEntries[:0]
+	t.logGrown = false
 }
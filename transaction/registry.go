@@ -0,0 +1,265 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Registry of transaction kinds. Each kind of transaction keeps its own log in
+ * persistent memory, reachable from a log head stored in the pool root, or uses
+ * the logs of other kinds. The built-in kinds (undo, redo, shadow, optimistic,
+ * read and shared) are registered by this package. Other packages can
+ * add their own kinds by registering a Factory before the pool is initialized,
+ * usually from an init() function. pmem.Init() then allocates or recovers the
+ * log of every registered kind.
+ * E.g.:
+ *     func init() {
+ *         transaction.Register("myTx", transaction.Factory{
+ *             Init:    initMyLog,
+ *             Recover: recoverMyLog,
+ *             Acquire: newMyTx,
+ *             Release: releaseMyTx,
+ *         })
+ *     }
+ *     ...
+ *     tx := transaction.New("myTx")
+ *     ...
+ *     transaction.Release(tx)
+ */
+
+package transaction
+
+import (
+	"log"
+	"reflect"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// Factory holds the hooks implementing a kind of transaction.
+type Factory struct {
+	// Init allocates the log of this kind in persistent memory on first time
+	// initialization of the pool, and returns a pointer to the log head.
+	Init func() unsafe.Pointer
+
+	// Recover completes or reverts the transactions pending in the log at
+	// logHeadPtr, and sets up any volatile state needed to hand out
+	// transaction handles. If swizzle is true, it is called during heap
+	// recovery before the runtime swizzles the pointers in the pool. In that
+	// case logHeadPtr is already swizzled, but any pointer read from the log
+	// must be swizzled using runtime.SwizzlePointer() before use. Recover is
+	// later called again with swizzle set to false.
+	Recover func(logHeadPtr unsafe.Pointer, swizzle bool)
+
+	// Acquire returns a transaction handle of this kind.
+	Acquire func() TX
+
+	// Release releases a transaction handle returned by Acquire.
+	Release func(TX)
+
+	// head returns the log head in use once the log is recovered. It is set
+	// for the built-in kinds whose logs are migrated from older layouts when
+	// recovered.
+	head func() unsafe.Pointer
+}
+
+var (
+	regMu sync.RWMutex
+	// Registered kinds, in the order in which they were registered
+	kinds     []string
+	factories = make(map[string]*Factory)
+	// Factory of the registered kind each type of handle belongs to. This is
+	// filled in when handles are acquired through New().
+	handleTypes = make(map[reflect.Type]*Factory)
+)
+
+func init() {
+	// The undo log is registered first, so that it is ready when the log
+	// heads of the other kinds are added to the pool root.
+	registerBuiltin("undo", (*undoTx)(nil), Factory{
+		Init: func() unsafe.Pointer {
+			return initUndoTx(nil)
+		},
+		Recover: func(logHeadPtr unsafe.Pointer, swizzle bool) {
+			if swizzle {
+				swizzleAndAbortUndo(logHeadPtr)
+			} else {
+				initUndoTx(logHeadPtr)
+			}
+		},
+		Acquire: NewUndoTx,
+		Release: func(t TX) { releaseUndoTx(t.(*undoTx)) },
+		head:    func() unsafe.Pointer { return unsafe.Pointer(txHeaderPtr) },
+	})
+	registerBuiltin("redo", (*redoTx)(nil), Factory{
+		Init: func() unsafe.Pointer {
+			return initRedoTx(nil)
+		},
+		Recover: func(logHeadPtr unsafe.Pointer, swizzle bool) {
+			// Redo log entries are applied or dropped after the pointers are
+			// swizzled
+			if !swizzle {
+				initRedoTx(logHeadPtr)
+			}
+		},
+		Acquire: NewRedoTx,
+		Release: func(t TX) { releaseRedoTx(t.(*redoTx)) },
+		head:    func() unsafe.Pointer { return unsafe.Pointer(headerPtr) },
+	})
+	// The kinds below use the undo and redo logs
+	registerBuiltin("shadow", (*shadowTx)(nil), Factory{
+		Acquire: NewShadowTx,
+		Release: func(t TX) { releaseShadowTx(t.(*shadowTx)) },
+	})
+	registerBuiltin("optimistic", (*optimisticTx)(nil), Factory{
+		Acquire: NewOptimisticTx,
+		Release: func(t TX) { releaseOptimisticTx(t.(*optimisticTx)) },
+	})
+	registerBuiltin("read", (*readTx)(nil), Factory{
+		Acquire: NewReadTx,
+		Release: func(t TX) { releaseReadTx(t.(*readTx)) },
+	})
+	registerBuiltin("shared", (*sharedTx)(nil), Factory{
+		Acquire: func() TX { return NewSharedTx() },
+		Release: func(t TX) { releaseSharedTx(t.(*sharedTx)) },
+	})
+	// Resumable transactions are acquired by name, and sub-transactions from
+	// their shared transaction, so these are not kinds acquired using New().
+	handleTypes[reflect.TypeOf((*resumableTx)(nil))] = &Factory{
+		Release: func(t TX) { releaseResumableTx(t.(*resumableTx)) },
+	}
+	handleTypes[reflect.TypeOf((*subTx)(nil))] = &Factory{
+		// Released when the shared transaction ends
+		Release: func(TX) {},
+	}
+}
+
+// registerBuiltin registers a kind implemented by this package, along with the
+// type of its handles, so that handles acquired without New() can be released
+// using Release().
+func registerBuiltin(kind string, handle TX, f Factory) {
+	Register(kind, f)
+	handleTypes[reflect.TypeOf(handle)] = factories[kind]
+}
+
+// Register adds a kind of transaction implemented by the hooks in f. Kinds must
+// be registered before pmem.Init() is called. It panics if kind is empty or
+// already registered, if Acquire or Release is nil, or if only one of Init and
+// Recover is nil.
+func Register(kind string, f Factory) {
+	if kind == "" {
+		log.Panic("Registering transaction kind with an empty name")
+	}
+	if f.Acquire == nil || f.Release == nil ||
+		(f.Init == nil) != (f.Recover == nil) {
+		log.Panic("Registering transaction kind ", kind, " with a nil hook")
+	}
+	regMu.Lock()
+	defer regMu.Unlock()
+	if _, ok := factories[kind]; ok {
+		log.Panic("Transaction kind ", kind, " is already registered")
+	}
+	kinds = append(kinds, kind)
+	factories[kind] = &f
+}
+
+// Kinds returns the registered kinds of transactions, in the order in which
+// they were registered.
+func Kinds() []string {
+	regMu.RLock()
+	defer regMu.RUnlock()
+	return append([]string(nil), kinds...)
+}
+
+// Registered returns true if kind has been registered.
+func Registered(kind string) bool {
+	return factory(kind) != nil
+}
+
+func factory(kind string) *Factory {
+	regMu.RLock()
+	defer regMu.RUnlock()
+	return factories[kind]
+}
+
+// New returns a transaction handle of a registered kind. The handle must be
+// released using Release().
+func New(kind string) TX {
+	f := factory(kind)
+	if f == nil {
+		log.Panic("Transaction kind ", kind, " is not registered")
+	}
+	t := f.Acquire()
+	typ := reflect.TypeOf(t)
+	regMu.RLock()
+	known := handleTypes[typ] == f
+	regMu.RUnlock()
+	if !known {
+		regMu.Lock()
+		handleTypes[typ] = f
+		regMu.Unlock()
+	}
+	return t
+}
+
+// releaser returns the Release hook for handles of the same type as t, if t is a
+// handle of a built-in kind or was acquired through New().
+func releaser(t TX) func(TX) {
+	regMu.RLock()
+	defer regMu.RUnlock()
+	if f, ok := handleTypes[reflect.TypeOf(t)]; ok {
+		return f.Release
+	}
+	return nil
+}
+
+// SwizzleAndAbort is registered as a callback with the runtime, and is called
+// during heap recovery before pointers are swizzled. It calls the Recover hook
+// of every registered kind which has a log in the pool, so that pending updates
+// can be reverted before swizzling. rootPtr is the swizzled root pointer set by
+// the application.
+func SwizzleAndAbort(rootPtr unsafe.Pointer) {
+	// pmemHeader definition is not available here.
+	type txHead struct {
+		kind []byte
+		ptr  unsafe.Pointer
+	}
+	type pmh struct {
+		version int
+		txHeads []txHead
+		appData []int // namedObject definition not available here
+	}
+	// Header of pools created before the table of log heads was added. Its
+	// first word is the undo log head, which never matches the version.
+	type legacyPmh struct {
+		undoTxHeadPtr unsafe.Pointer
+		redoTxHeadPtr unsafe.Pointer
+		appData       []int
+	}
+	const rootVersion = 1 // Must match the version written by pmem.Init()
+	appRootPtr := (*pmh)(rootPtr)
+	if appRootPtr.version != rootVersion {
+		legacyRootPtr := (*legacyPmh)(rootPtr)
+		undoTxSwizzled := runtime.SwizzlePointer(uintptr(legacyRootPtr.undoTxHeadPtr))
+		factory("undo").Recover(unsafe.Pointer(undoTxSwizzled), true)
+		return
+	}
+	n := len(appRootPtr.txHeads)
+	if n == 0 {
+		return
+	}
+	headsSwizzled := runtime.SwizzlePointer(uintptr(unsafe.Pointer(&appRootPtr.txHeads[0])))
+	heads := (*[maxInt / 32]txHead)(unsafe.Pointer(headsSwizzled))[:n:n]
+	for _, h := range heads {
+		if len(h.kind) == 0 {
+			continue
+		}
+		kindSwizzled := runtime.SwizzlePointer(uintptr(unsafe.Pointer(&h.kind[0])))
+		kind := (*[maxInt]byte)(unsafe.Pointer(kindSwizzled))[:len(h.kind):len(h.kind)]
+		f := factory(string(kind))
+		if f == nil || f.Recover == nil {
+			// pmem.Init() fails on finding a log of an unregistered kind
+			continue
+		}
+		f.Recover(unsafe.Pointer(runtime.SwizzlePointer(uintptr(h.ptr))), true)
+	}
+}
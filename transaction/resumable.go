@@ -0,0 +1,308 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Resumable redo transactions. A resumable transaction has a name, and is not
+ * dropped when the application restarts before it commits. Every time the
+ * outermost transaction ends, the log is checkpointed in persistent memory
+ * instead of being committed. After a restart, ResumeRedo() reattaches the
+ * transaction by its name, with the log as of the last checkpoint, so that
+ * more updates can be logged. The updates are applied only when Commit() is
+ * called, and are dropped when Discard() is called.
+ * E.g.:
+ *     tx, err := transaction.ResumeRedo("import")
+ *     if err != nil {
+ *         tx, err = transaction.NewResumableRedo("import")
+ *     }
+ *     for batch := range batches {
+ *         tx.Begin()
+ *         tx.Log(...)
+ *         tx.End() // checkpoints the log
+ *     }
+ *     tx.Commit() // applies all updates logged in every batch
+ *
+ * The handle of a resumable transaction is a redo log handle, which stays in
+ * use until the transaction is committed or discarded. Release() detaches the
+ * transaction from the caller, dropping any updates not yet checkpointed, so
+ * that it can be resumed later.
+ *
+ * Locks acquired by a resumable transaction are kept across checkpoints, as
+ * long as the transaction stays attached. They are released when it is
+ * committed, discarded or detached, when a batch is rolled back, and on a
+ * restart. Once released, other transactions may update the data logged in
+ * earlier checkpoints, and Commit() overwrites those updates.
+ */
+
+package transaction
+
+import (
+	"errors"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// ResumableTX is a redo transaction which survives a restart until its updates
+// are explicitly committed or discarded. Its locks are held until it is
+// committed, discarded or detached, or a batch is rolled back.
+type ResumableTX interface {
+	TX
+	// Commit applies all updates checkpointed by the transaction. It must be
+	// called after the outermost transaction ends. The handle must not be
+	// used after this.
+	Commit() error
+	// Discard drops all updates logged by the transaction. The handle must
+	// not be used after this.
+	Discard() error
+}
+
+type resumableTx struct {
+	*redoTx
+}
+
+// A resumable transaction, and whether it is currently attached to a caller
+type resumable struct {
+	tx       *redoTx
+	attached bool
+}
+
+var (
+	resumableMu sync.Mutex
+	// Resumable transactions found during recovery or created since, by name
+	resumables map[string]*resumable
+)
+
+// NewResumableRedo returns a new resumable transaction named 'name'. It blocks
+// till a redo log handle is available. An error is returned if a transaction
+// with this name exists.
+func NewResumableRedo(name string) (ResumableTX, error) {
+	if headerPtr == nil || headerPtr.magic != magic {
+		log.Fatal("redo log not correctly initialized!")
+	}
+	if name == "" {
+		return nil, errors.New("[redoTx] NewResumableRedo: Name must not " +
+			"be empty")
+	}
+	index := redoArray.nextAvailable()
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	if _, ok := resumables[name]; ok {
+		redoArray.clearBit(index)
+		return nil, errors.New("[redoTx] NewResumableRedo: A transaction " +
+			"named " + name + " exists")
+	}
+	t := redoHandle(index)
+	t.setName(name)
+	resumables[name] = &resumable{tx: t, attached: true}
+	return &resumableTx{t}, nil
+}
+
+// ResumeRedo reattaches the resumable transaction named 'name', with all
+// updates it checkpointed. An error is returned if there is no such
+// transaction, or if it is attached to another caller.
+func ResumeRedo(name string) (ResumableTX, error) {
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	r, ok := resumables[name]
+	if !ok {
+		return nil, errors.New("[redoTx] ResumeRedo: No transaction named " +
+			name)
+	}
+	if r.attached {
+		return nil, errors.New("[redoTx] ResumeRedo: Transaction " + name +
+			" is in use")
+	}
+	r.attached = true
+	return &resumableTx{r.tx}, nil
+}
+
+// ResumableRedoNames returns the names of all resumable transactions which are
+// not yet committed or discarded, in sorted order.
+func ResumableRedoNames() []string {
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	names := make([]string, 0, len(resumables))
+	for name := range resumables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// releaseResumableTx detaches the transaction, so that it can be resumed
+// again. Any updates logged since the last checkpoint are dropped.
+func releaseResumableTx(t *resumableTx) {
+	t.abort()
+	resumableMu.Lock()
+	if r, ok := resumables[string(t.name)]; ok {
+		r.attached = false
+	}
+	resumableMu.Unlock()
+}
+
+func (t *resumableTx) Commit() error {
+	if t.level != 0 {
+		return errors.New("[redoTx] Commit: Transaction has not ended")
+	}
+	name := string(t.name)
+	// The log is as of the last checkpoint. Persist the handle, which may
+	// have been updated by a transaction rolled back since, before marking
+	// it committed. Once the name is cleared, the log is applied by recovery
+	// like that of any committed redo transaction.
+	t.fs.insert(uintptr(unsafe.Pointer(t.redoTx)), unsafe.Sizeof(*t.redoTx))
+	t.fs.flushAndFence()
+	runtime.PersistRange(t.markCommitted())
+	t.unname()
+	if t.updatesVersioned() {
+		t.snapshotCommit()
+	} else {
+		t.commit(false)
+	}
+	t.detach(name)
+	return nil
+}
+
+func (t *resumableTx) Discard() error {
+	name := string(t.name)
+	t.unname()
+	t.abort()
+	t.detach(name)
+	return nil
+}
+
+// detach removes the transaction from the list of resumable transactions and
+// releases its redo log handle.
+func (t *resumableTx) detach(name string) {
+	resumableMu.Lock()
+	delete(resumables, name)
+	resumableMu.Unlock()
+	redoArray.clearBit(t.index)
+}
+
+// recoverResumable restores the log of the resumable transaction 't' as of its
+// last checkpoint. A transaction which crashed while committing is committed
+// again. Returns true if the transaction is still to be committed or
+// discarded.
+func recoverResumable(t *redoTx) bool {
+	t.restore()
+	if t.status == redoCommitted {
+		t.unname()
+		t.commit(true)
+		return false
+	}
+	return true
+}
+
+// setName makes 't' a resumable transaction named 'name', with an empty log
+// as its first checkpoint.
+func (t *redoTx) setName(name string) {
+	n := pmake([]byte, len(name))
+	copy(n, name)
+	runtime.PersistRange(unsafe.Pointer(&n[0]), uintptr(len(n)))
+	t.ckpt = redoCkpt{log: t.log, curr: t.first}
+	runtime.PersistRange(unsafe.Pointer(&t.ckpt), unsafe.Sizeof(t.ckpt))
+	t.name = n
+	runtime.PersistRange(unsafe.Pointer(&t.name), unsafe.Sizeof(t.name))
+}
+
+// unname makes 't' an ordinary redo transaction. The name is cleared before
+// the checkpoint, so that recovery never finds a named transaction without
+// its checkpoint.
+func (t *redoTx) unname() {
+	t.name = nil
+	runtime.PersistRange(unsafe.Pointer(&t.name), unsafe.Sizeof(t.name))
+	t.ckpt = redoCkpt{}
+	runtime.PersistRange(unsafe.Pointer(&t.ckpt), unsafe.Sizeof(t.ckpt))
+}
+
+// frozen returns true if the log entry at index 'i' is part of the checkpoint
+// of a resumable transaction, and so must not be updated.
+func (t *redoTx) frozen(i int) bool {
+	return t.name != nil && i < t.ckpt.tail
+}
+
+// checkpoint persists the log of a resumable transaction, including the
+// contents of any new slices logged, and records the log as its checkpoint.
+// The entries in the checkpoint are never updated after this, so any crash
+// leaves the log as of either this checkpoint or the previous one. Locks are
+// kept, so that the checkpointed data is not updated by other transactions
+// before it is committed.
+func (t *redoTx) checkpoint() {
+	for i := t.tail - 1; i >= t.ckpt.tail; i-- {
+		t.fs.insert(uintptr(t.log[i].data), uintptr(t.log[i].size))
+	}
+	t.insertSlices(t.ckpt.tail)
+	// Only the entries added since the last checkpoint are flushed, unless the
+	// log was expanded into a new array, which is not flushed when copied.
+	first := t.ckpt.tail
+	if len(t.ckpt.log) == 0 || &t.ckpt.log[0] != &t.log[0] {
+		first = 0
+	}
+	if first < t.tail {
+		t.fs.insert(uintptr(unsafe.Pointer(&t.log[first])),
+			uintptr(t.tail-first)*unsafe.Sizeof(t.log[0]))
+	}
+	raw := t.checkpointRaw()
+	t.fs.insert(uintptr(unsafe.Pointer(t)), unsafe.Sizeof(*t))
+	t.fs.flushAndFence()
+	t.ckpt = redoCkpt{t.log, t.tail, t.curr, t.dataTail, raw}
+	runtime.PersistRange(unsafe.Pointer(&t.ckpt), unsafe.Sizeof(t.ckpt))
+}
+
+// checkpointRaw appends the indices of the entries logged as ranges of bytes
+// since the last checkpoint to the list in the checkpoint, and returns the new
+// list. The elements appended are added to the flush set.
+func (t *redoTx) checkpointRaw() []int {
+	raw := t.ckpt.raw
+	n := len(raw)
+	if n == len(t.rawEntries) {
+		return raw
+	}
+	if len(t.rawEntries) > cap(raw) {
+		// Elements before n are not updated in the old array, as they are
+		// part of the last checkpoint.
+		newRaw := pmake([]int, n, 2*len(t.rawEntries))
+		copy(newRaw, raw)
+		raw = newRaw
+		n = 0
+	}
+	raw = append(raw, t.rawEntries[len(raw):]...)
+	t.fs.insert(uintptr(unsafe.Pointer(&raw[n])), uintptr(len(raw)-n)*unsafe.Sizeof(raw[0]))
+	return raw
+}
+
+// rollback drops the updates logged by a resumable transaction since its last
+// checkpoint, and releases all locks held.
+func (t *redoTx) rollback() {
+	defer t.unLock()
+	t.restore()
+}
+
+// restore sets the log of a resumable transaction to its last checkpoint, and
+// rebuilds the volatile state describing the log.
+func (t *redoTx) restore() {
+	t.level = 0
+	t.log = t.ckpt.log
+	t.nEntry = len(t.log)
+	t.tail = t.ckpt.tail
+	t.curr = t.ckpt.curr
+	if t.curr == nil {
+		// The arena was allocated after the checkpoint
+		t.curr = t.first
+	}
+	t.dataTail = t.ckpt.dataTail
+	for k := range t.m {
+		delete(t.m, k)
+	}
+	for i := 0; i < t.tail; i++ {
+		t.m[t.log[i].ptr] = i
+	}
+	t.rawEntries = append(t.rawEntries[:0], t.ckpt.raw...)
+	// The contents of slices logged before the checkpoint were persisted by
+	// the checkpoint.
+	t.storeSliceHdr = t.storeSliceHdr[:0]
+	t.writeSet = t.writeSet[:0]
+}
@@ -0,0 +1,159 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Copy-on-write shadow transactions. Instead of copying the data to be updated
+ * into a log, the object pointed to by a parent pointer is cloned into new
+ * persistent memory when it is first logged, and the application updates the
+ * clone. When the transaction ends, the clones are published by swinging the
+ * parent pointers to them. Each pointer swing is recorded in the undo log of
+ * the underlying undo transaction, so a crash before the transaction ends
+ * reverts the parent pointers, leaving the clones unreachable.
+ * E.g.:
+ *     type S struct {
+ *         Obj *BigObject
+ *     }
+ *     tx := NewShadowTx()
+ *     tx.Begin()
+ *     tx.Log(&S.Obj)
+ *     clone := tx.ReadLog(&S.Obj).(*BigObject)
+ *     clone.A = 10 // S.Obj.A is unchanged until tx.End()
+ *     tx.End() // S.Obj points to the clone after this
+ *     transaction.Release(tx)
+ */
+
+package transaction
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"unsafe"
+)
+
+type shadowTx struct {
+	*undoTx
+
+	// Maps the address of each parent pointer logged to the clone of the
+	// object it points to. order holds the addresses of the parent pointers in
+	// the order in which they were logged.
+	clones map[unsafe.Pointer]reflect.Value
+	order  []unsafe.Pointer
+}
+
+// NewShadowTx returns a copy-on-write shadow transaction handle. Shadow
+// transactions use the undo log handles, so the undo log must be initialized.
+func NewShadowTx() TX {
+	t := NewUndoTx().(*undoTx)
+	return &shadowTx{undoTx: t, clones: make(map[unsafe.Pointer]reflect.Value)}
+}
+
+func releaseShadowTx(t *shadowTx) {
+	t.reset()
+	releaseUndoTx(t.undoTx)
+}
+
+// reset drops all clones made by the transaction.
+func (t *shadowTx) reset() {
+	for pp := range t.clones {
+		delete(t.clones, pp)
+	}
+	for i := range t.order {
+		t.order[i] = nil
+	}
+	t.order = t.order[:0]
+}
+
+func (t *shadowTx) Begin(d ...Durability) error {
+	if t.level == 0 {
+		// Clones made by an earlier transaction aborted internally, e.g. on a
+		// deadlock, are dropped.
+		t.reset()
+	}
+	return t.undoTx.Begin(d...)
+}
+
+// Log clones the object pointed to by a parent pointer. The expected syntax is
+// Log(&ptr). The clone can be read and updated using ReadLog(&ptr), and ptr is
+// updated to point to the clone when the transaction ends. Logging the same
+// parent pointer again does nothing.
+func (t *shadowTx) Log(intf ...interface{}) error {
+	if len(intf) != 1 {
+		return errors.New("[shadowTx] Log: Incorrectly called. Correct " +
+			"usage: Log(&ptr)")
+	}
+	ppV := reflect.ValueOf(intf[0])
+	if ppV.Kind() != reflect.Ptr || ppV.Elem().Kind() != reflect.Ptr {
+		return errors.New("[shadowTx] Log: Arg must be a pointer to a pointer")
+	}
+	pp := unsafe.Pointer(ppV.Pointer())
+	if _, ok := t.clones[pp]; ok {
+		return nil
+	}
+	pV := ppV.Elem()
+	if pV.IsNil() {
+		return errors.New("[shadowTx] Log: Cannot clone a nil object")
+	}
+	if !runtime.InPmem(uintptr(pp)) {
+		return errors.New("[shadowTx] Log: Updates to data in volatile memory" +
+			" can be lost")
+	}
+	if err := t.lockRange(pp, ptrSize); err != nil {
+		return err
+	}
+	clone := reflect.PNew(pV.Type().Elem())
+	clone.Elem().Set(pV.Elem())
+	t.clones[pp] = clone
+	t.order = append(t.order, pp)
+	return nil
+}
+
+// ReadLog returns the clone of the object pointed to by ptr, if ReadLog(&ptr)
+// is called after Log(&ptr). All other calls are handled as in undo
+// transactions.
+func (t *shadowTx) ReadLog(intf ...interface{}) interface{} {
+	if len(intf) == 1 {
+		ppV := reflect.ValueOf(intf[0])
+		if ppV.Kind() == reflect.Ptr {
+			if clone, ok := t.clones[unsafe.Pointer(ppV.Pointer())]; ok {
+				return clone.Interface()
+			}
+		}
+	}
+	return t.undoTx.ReadLog(intf...)
+}
+
+func (t *shadowTx) Exec(intf ...interface{}) (retVal []reflect.Value,
+	err error) {
+	retVal, _, err = execTx("shadowTx", t, &t.level, intf)
+	return retVal, err
+}
+
+/* When the outermost transaction ends, each parent pointer logged is recorded in
+ * the undo log and updated to point to its clone. The clones and the parent
+ * pointers are then persisted together when the underlying undo transaction
+ * ends. If a parent pointer cannot be recorded in the undo log, the transaction
+ * is aborted, which reverts the parent pointers already updated. Returns a bool
+ * indicating if it is safe to release the transaction handle.
+ */
+func (t *shadowTx) End() bool {
+	if t.level != 1 {
+		return t.undoTx.End()
+	}
+	for _, pp := range t.order {
+		clone := t.clones[pp]
+		if err := t.undoTx.Log3(pp, ptrSize); err != nil {
+			t.reset()
+			if t.level != 0 {
+				// Not aborted by Log3() already
+				t.undoTx.abort(false)
+			}
+			return true
+		}
+		reflect.NewAt(clone.Type(), pp).Elem().Set(clone)
+		t.fs.insert(clone.Pointer(), clone.Type().Elem().Size())
+	}
+	t.reset()
+	return t.undoTx.End()
+}
@@ -0,0 +1,245 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Shared transactions. A transaction handle must not be used by more than one
+ * goroutine at a time. A shared transaction lets many worker goroutines update
+ * data as part of one transaction, by giving each worker a sub-transaction
+ * handle with a redo log of its own. All the logs of a shared transaction are
+ * linked to a group in persistent memory. When the parent transaction ends,
+ * all logs are persisted and the group is marked committed, after which the
+ * updates in every log are applied. On a restart, the logs of a committed group
+ * are applied and those of any other group are dropped, so either all or none
+ * of the updates of a shared transaction survive a crash.
+ * E.g.:
+ *     tx := transaction.NewSharedTx()
+ *     tx.Begin()
+ *     for w := 0; w < workers; w++ {
+ *         sub, _ := tx.Sub()
+ *         wg.Add(1)
+ *         go func() {
+ *             sub.Begin()
+ *             sub.Log(...)
+ *             sub.End() // updates are not committed yet
+ *             wg.Done()
+ *         }()
+ *     }
+ *     wg.Wait()
+ *     tx.End() // commits the updates of all workers
+ *     transaction.Release(tx)
+ *
+ * The workers must update disjoint data. A sub-transaction does not see the
+ * updates logged by other sub-transactions, and its locks are held until the
+ * parent transaction ends. If any sub-transaction aborts, for instance on a
+ * deadlock, the whole shared transaction is rolled back when it ends.
+ */
+
+package transaction
+
+import (
+	"errors"
+	"log"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+type (
+	// The commit status of a shared transaction, to which the redo logs of
+	// all its handles are linked
+	redoGroup struct {
+		committed bool
+		// aborted is set if any handle aborts. This is accessed atomically,
+		// and is only used in volatile memory.
+		aborted int32
+	}
+
+	// A shared transaction. Updates logged through the shared transaction
+	// itself are stored in the redo log of its own handle.
+	sharedTx struct {
+		*redoTx
+		group *redoGroup
+		mu    sync.Mutex
+		subs  []*redoTx
+		// Outcome of the last shared transaction which ended
+		err error
+	}
+
+	// A sub-transaction handle of a shared transaction
+	subTx struct {
+		*redoTx
+	}
+)
+
+// SharedTX is a transaction whose updates can be logged concurrently by many
+// goroutines, using sub-transaction handles.
+type SharedTX interface {
+	TX
+	// Sub returns a sub-transaction handle, to be used by a single goroutine.
+	// It must be called within the parent transaction. The updates logged
+	// through it are committed or rolled back along with the parent
+	// transaction, after which the handle must not be used.
+	Sub() (TX, error)
+	// Err returns ErrRolledBack if the last shared transaction to end was
+	// rolled back because a sub-transaction aborted, and nil otherwise.
+	Err() error
+}
+
+// ErrRolledBack is returned by SharedTX.Err() if the updates of a shared
+// transaction were discarded when it ended, because a sub-transaction aborted.
+var ErrRolledBack = errors.New("A sub-transaction aborted, shared transaction " +
+	"rolled back")
+
+// NewSharedTx returns a shared transaction handle. It blocks till a redo log
+// handle is available.
+func NewSharedTx() SharedTX {
+	if headerPtr == nil || headerPtr.magic != magic {
+		log.Fatal("redo log not correctly initialized!")
+	}
+	index := redoArray.nextAvailable()
+	return &sharedTx{redoTx: redoHandle(index)}
+}
+
+func releaseSharedTx(t *sharedTx) {
+	if t.group != nil {
+		t.finish(false)
+	}
+	releaseRedoTx(t.redoTx)
+}
+
+// Begin starts a transaction. A shared transaction always has sync durability.
+// The outermost transaction links the log of the handle to a new group.
+func (t *sharedTx) Begin(d ...Durability) error {
+	if t.level == 0 {
+		code, err := durabilityCode(d)
+		if err != nil {
+			return errors.New("[sharedTx] " + err.Error())
+		}
+		if code != durSync {
+			return errors.New("[sharedTx] Begin: A shared transaction must " +
+				"have sync durability")
+		}
+		t.err = nil
+		t.group = pnew(redoGroup)
+		runtime.PersistRange(unsafe.Pointer(t.group), unsafe.Sizeof(*t.group))
+		t.redoTx.link(t.group)
+	}
+	return t.redoTx.Begin(d...)
+}
+
+func (t *sharedTx) Sub() (TX, error) {
+	if t.level == 0 {
+		return nil, errors.New("[sharedTx] Sub: Transaction has not begun")
+	}
+	h := redoHandle(redoArray.nextAvailable())
+	h.link(t.group)
+	t.mu.Lock()
+	t.subs = append(t.subs, h)
+	t.mu.Unlock()
+	return &subTx{h}, nil
+}
+
+/* When the outermost transaction ends, the updates logged through the shared
+ * transaction and all its sub-transactions are committed, unless any of them
+ * aborted, in which case Err() returns ErrRolledBack. All sub-transactions must
+ * have ended before this. Returns a bool indicating if it is safe to release the
+ * transaction handle.
+ */
+func (t *sharedTx) End() bool {
+	if t.level == 0 {
+		return true
+	}
+	t.redoTx.End()
+	if t.level > 0 {
+		return false
+	}
+	commit := atomic.LoadInt32(&t.group.aborted) == 0
+	t.finish(commit)
+	if !commit {
+		t.err = ErrRolledBack
+	}
+	return true
+}
+
+func (t *sharedTx) Err() error {
+	return t.err
+}
+
+// finish commits or rolls back the updates in the logs of all handles of the
+// shared transaction, and releases the sub-transaction handles. All logs are
+// persisted before the group is marked committed. Each log is applied and
+// unlinked from the group before it is reset, so that recovery either applies
+// a log again or finds it unlinked.
+func (t *sharedTx) finish(commit bool) {
+	t.mu.Lock()
+	subs := t.subs
+	t.subs = nil
+	t.mu.Unlock()
+	handles := append(subs, t.redoTx)
+	if commit {
+		for _, h := range subs {
+			if h.level != 0 {
+				log.Panic("[sharedTx] End: A sub-transaction has not ended")
+			}
+		}
+		for _, h := range handles {
+			for i := h.tail - 1; i >= 0; i-- {
+				t.fs.insert(uintptr(h.log[i].data), uintptr(h.log[i].size))
+			}
+			t.fs.insert(uintptr(unsafe.Pointer(&h.log[0])),
+				uintptr(h.tail)*unsafe.Sizeof(h.log[0]))
+			t.fs.insert(uintptr(unsafe.Pointer(h)), unsafe.Sizeof(*h))
+		}
+		t.fs.flushAndFence()
+		t.group.committed = true
+		runtime.PersistRange(unsafe.Pointer(&t.group.committed),
+			unsafe.Sizeof(t.group.committed))
+	}
+	for _, h := range handles {
+		if commit {
+			// Snapshots see all or none of the updates in each log
+			if h.updatesVersioned() {
+				h.snapshotApply()
+			} else {
+				h.applyLog(false)
+			}
+		}
+		h.unlink()
+		h.reset(h.tail)
+	}
+	for _, h := range subs {
+		redoArray.clearBit(h.index)
+	}
+	t.group = nil
+}
+
+// recoverShared applies the log of a handle of a shared transaction if the
+// transaction was committed, and drops it otherwise.
+func recoverShared(t *redoTx) {
+	if t.group.committed {
+		t.applyLog(true)
+	}
+	t.unlink()
+	t.reset(t.tail)
+}
+
+// link links the log of the handle to the group 'g'
+func (t *redoTx) link(g *redoGroup) {
+	t.group = g
+	runtime.PersistRange(unsafe.Pointer(&t.group), ptrSize)
+}
+
+// unlink removes the log of the handle from its group
+func (t *redoTx) unlink() {
+	t.group = nil
+	runtime.PersistRange(unsafe.Pointer(&t.group), ptrSize)
+}
+
+func (t *sharedTx) Exec(intf ...interface{}) (retVal []reflect.Value,
+	err error) {
+	retVal, _, err = execTx("sharedTx", t, &t.level, intf)
+	return retVal, err
+}
@@ -0,0 +1,224 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+/* Snapshot reads of objects registered as versioned. A redo transaction copies
+ * its updates to the app data structures one entry at a time, so a reader not
+ * holding the locks of the writer may see some updates of a transaction but
+ * not others. Snapshots avoid this for versioned objects.
+ *
+ * A reader pins the current commit epoch when it begins a snapshot. A redo
+ * transaction updating a versioned object publishes its log as the in-flight
+ * commit of the next epoch, and advances the epoch. Readers which pinned an
+ * older epoch see the data in place, and the transaction waits for them to
+ * finish before applying its updates. Readers which pinned the new epoch read
+ * the staged copies of the data in the log. Once the updates are applied, the
+ * in-flight commit is removed and the epoch is advanced again. The transaction
+ * then waits for the readers which may be reading the staged copies to finish,
+ * before the log is reset. So readers see either all or none of the updates of
+ * a transaction.
+ */
+
+package transaction
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// Snapshot provides a consistent view of versioned objects, as of the
+	// commit epoch pinned when the snapshot began.
+	Snapshot struct {
+		epoch uint64
+	}
+
+	// A redo transaction whose updates to versioned objects are being applied
+	inflightCommit struct {
+		tx    *redoTx
+		epoch uint64
+	}
+)
+
+var (
+	// Memory ranges of the versioned objects sorted by address, stored as
+	// []memRange. A new list is stored when an object is registered.
+	versioned   atomic.Value
+	versionedMu sync.Mutex
+
+	// The current commit epoch, and the number of snapshots that pinned each
+	// epoch. These are protected by snapMu. snapCond is signaled when all
+	// snapshots of an epoch end.
+	snapEpoch   uint64
+	snapReaders = make(map[uint64]int)
+	snapMu      sync.Mutex
+	snapCond    = sync.NewCond(&snapMu)
+
+	// The in-flight commit, of type *inflightCommit. Commits updating
+	// versioned objects are serialized by commitMu.
+	inflight atomic.Value
+	commitMu sync.Mutex
+)
+
+// RegisterVersioned registers the object pointed to by 'ptr' as versioned, so
+// that it can be read consistently using snapshots.
+func RegisterVersioned(ptr interface{}) {
+	r := objRange(ptr)
+	versionedMu.Lock()
+	defer versionedMu.Unlock()
+	old, _ := versioned.Load().([]memRange)
+	ranges := make([]memRange, len(old), len(old)+1)
+	copy(ranges, old)
+	ranges = append(ranges, r)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	versioned.Store(ranges)
+}
+
+// UnregisterVersioned removes the object pointed to by 'ptr' from the set of
+// versioned objects.
+func UnregisterVersioned(ptr interface{}) {
+	r := objRange(ptr)
+	versionedMu.Lock()
+	defer versionedMu.Unlock()
+	old, _ := versioned.Load().([]memRange)
+	ranges := make([]memRange, 0, len(old))
+	for _, o := range old {
+		if o != r {
+			ranges = append(ranges, o)
+		}
+	}
+	versioned.Store(ranges)
+}
+
+// objRange returns the memory range of the object pointed to by 'ptr'
+func objRange(ptr interface{}) memRange {
+	ptrV := reflect.ValueOf(ptr)
+	if ptrV.Kind() != reflect.Ptr {
+		panic("[Snapshot] RegisterVersioned: Arg must be pointer")
+	}
+	return memRange{ptrV.Pointer(), ptrV.Type().Elem().Size()}
+}
+
+// isVersioned returns true if any part of 'size' bytes at 'ptr' is in a
+// versioned object.
+func isVersioned(ranges []memRange, ptr, size uintptr) bool {
+	// Find the first object ending after ptr
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].start+ranges[i].size > ptr
+	})
+	for ; i < len(ranges) && ranges[i].start < ptr+size; i++ {
+		if ranges[i].start+ranges[i].size > ptr {
+			return true
+		}
+	}
+	return false
+}
+
+// BeginSnapshot begins a snapshot, pinning the current commit epoch. End() must
+// be called once the snapshot is no longer used, as transactions updating
+// versioned objects wait for older snapshots to end. So a goroutine must not
+// end a transaction updating versioned objects while it holds a snapshot.
+func BeginSnapshot() *Snapshot {
+	snapMu.Lock()
+	defer snapMu.Unlock()
+	snapReaders[snapEpoch]++
+	return &Snapshot{epoch: snapEpoch}
+}
+
+// End ends the snapshot.
+func (s *Snapshot) End() {
+	snapMu.Lock()
+	defer snapMu.Unlock()
+	snapReaders[s.epoch]--
+	if snapReaders[s.epoch] == 0 {
+		delete(snapReaders, s.epoch)
+		snapCond.Broadcast()
+	}
+}
+
+// Read returns the value of the data pointed to by 'ptr', as of the epoch
+// pinned by the snapshot. 'ptr' must point into a versioned object.
+func (s *Snapshot) Read(ptr interface{}) interface{} {
+	ptrV := reflect.ValueOf(ptr)
+	if ptrV.Kind() != reflect.Ptr {
+		panic("[Snapshot] Read: Arg must be pointer")
+	}
+	c, _ := inflight.Load().(*inflightCommit)
+	if c != nil && c.epoch <= s.epoch {
+		return c.tx.readLogEntry(ptrV.Pointer(), ptrV.Type().Elem()).Interface()
+	}
+	return ptrV.Elem().Interface()
+}
+
+// advanceEpoch publishes 'c' as the in-flight commit and advances the commit
+// epoch. It returns the new epoch.
+func advanceEpoch(c *inflightCommit) uint64 {
+	snapMu.Lock()
+	defer snapMu.Unlock()
+	if c != nil {
+		c.epoch = snapEpoch + 1
+	}
+	inflight.Store(c)
+	snapEpoch++
+	return snapEpoch
+}
+
+// waitSnapshots waits for all snapshots which pinned an epoch older than
+// 'epoch' to end.
+func waitSnapshots(epoch uint64) {
+	snapMu.Lock()
+	defer snapMu.Unlock()
+	for {
+		waiting := false
+		for e := range snapReaders {
+			if e < epoch {
+				waiting = true
+				break
+			}
+		}
+		if !waiting {
+			return
+		}
+		snapCond.Wait()
+	}
+}
+
+// updatesVersioned returns true if the transaction updates any versioned
+// object.
+func (t *redoTx) updatesVersioned() bool {
+	ranges, _ := versioned.Load().([]memRange)
+	if len(ranges) == 0 {
+		return false
+	}
+	for i := 0; i < t.tail; i++ {
+		if isVersioned(ranges, uintptr(t.log[i].ptr),
+			uintptr(t.log[i].size)) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotCommit applies the updates of a committed transaction such that
+// snapshots see either all or none of them.
+func (t *redoTx) snapshotCommit() {
+	t.snapshotApply()
+	t.endCommit()
+}
+
+// snapshotApply applies the updates in the log such that snapshots see either
+// all or none of them. Once it returns, no snapshot reads the log.
+func (t *redoTx) snapshotApply() {
+	commitMu.Lock()
+	defer commitMu.Unlock()
+	epoch := advanceEpoch(&inflightCommit{tx: t})
+	waitSnapshots(epoch)
+	t.applyLog(false)
+	epoch = advanceEpoch(nil)
+	waitSnapshots(epoch)
+}
@@ -6,34 +6,47 @@
 package transaction
 
 import (
+	"errors"
 	"log"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
 const (
 	maxInt     = 1<<31 - 1
-	magic      = 131071
+	magic      = 524287
 	logNum     = 512
 	NumEntries = 128
 	ptrSize    = 8 // Size of an integer or pointer value in Go
 	cacheSize  = 64
+
+	// Magic constant of undo and redo logs created before the log handles
+	// were split into segments. Such logs are migrated when recovered.
+	legacyMagic = 131071
 )
 
+// ErrNoHandle is returned when no transaction handle is available, either
+// immediately or within the timeout given.
+var ErrNoHandle = errors.New("No transaction handle available")
+
 // transaction interface
 type (
 	TX interface {
-		Begin() error
+		Begin(...Durability) error
 		Log(...interface{}) error
 		Log2(src, dst unsafe.Pointer, size uintptr) error
 		Log3(src unsafe.Pointer, size uintptr) error
+		LogRange(slice interface{}, start int, elems interface{}) error
 		ReadLog(...interface{}) interface{}
 		Exec(...interface{}) ([]reflect.Value, error)
 		End() bool
-		RLock(*sync.RWMutex)
-		WLock(*sync.RWMutex)
-		Lock(*sync.RWMutex)
+		RLock(*sync.RWMutex) error
+		WLock(*sync.RWMutex) error
+		Lock(*sync.RWMutex) error
+		LockAll(...*sync.RWMutex) error
+		Read(ptr unsafe.Pointer, size uintptr) error
 	}
 
 	// entry for each log update, stays in persistent heap.
@@ -47,25 +60,159 @@ type (
 	}
 )
 
+// Init initializes the log of a registered kind of transaction. If logHeadPtr is
+// nil, a new log is allocated. Otherwise the transactions pending in the log
+// at logHeadPtr are recovered. Returns a pointer to the log head, or nil if the
+// kind keeps no log of its own (e.g. shadow transactions use the undo log). The
+// returned log head differs from logHeadPtr if the log was migrated from an
+// older layout, and must then be stored in place of logHeadPtr.
 func Init(logHeadPtr unsafe.Pointer, logType string) unsafe.Pointer {
+	f := factory(logType)
+	if f == nil {
+		log.Panic("initializing unsupported transaction! Try undo/redo " +
+			"or a registered kind")
+	}
+	if f.Init == nil {
+		return nil
+	}
+	if logHeadPtr == nil {
+		return f.Init()
+	}
+	f.Recover(logHeadPtr, false)
+	if f.head != nil {
+		// The log may have been migrated to a new log head
+		return f.head()
+	}
+	return logHeadPtr
+}
+
+// Waiters returns the number of goroutines waiting for a transaction handle of
+// type logType ("undo" or "redo") to be released.
+func Waiters(logType string) int {
 	switch logType {
 	case "undo":
-		return initUndoTx(logHeadPtr)
+		if undoArray != nil {
+			return undoArray.numWaiters()
+		}
 	case "redo":
-		return initRedoTx(logHeadPtr)
+		if redoArray != nil {
+			return redoArray.numWaiters()
+		}
 	default:
-		log.Panic("initializing unsupported transaction! Try undo/redo")
+		log.Panic("unsupported transaction type! Try undo/redo")
+	}
+	return 0
+}
+
+// SetMaxHandles sets the maximum number of transaction handles of type logType
+// ("undo" or "redo"). When all handles are in use, more handles are allocated in
+// persistent memory, 512 at a time, until this limit is reached. By default, or
+// if n <= 0, there is no limit. Handles already allocated are never freed.
+func SetMaxHandles(logType string, n int) {
+	switch logType {
+	case "undo":
+		atomic.StoreInt64(&maxUndoHandles, int64(n))
+	case "redo":
+		atomic.StoreInt64(&maxRedoHandles, int64(n))
+	default:
+		log.Panic("unsupported transaction type! Try undo/redo")
+	}
+}
+
+// checkRange validates the arguments passed to LogRange()
+func checkRange(sV reflect.Value, start int, eV reflect.Value) error {
+	if sV.Kind() != reflect.Slice || eV.Kind() != reflect.Slice {
+		return errors.New("LogRange Error. slice and elems passed to " +
+			"LogRange() must be slices")
+	}
+	if sV.Type() != eV.Type() {
+		return errors.New("LogRange Error. slice and elems passed to " +
+			"LogRange() are not of the same type")
+	}
+	if start < 0 || start+eV.Len() > sV.Len() {
+		return errors.New("LogRange Error. Index out of bounds")
 	}
 	return nil
 }
 
+// execTx implements Exec() for the transaction handle t, whose nesting level is
+// read from level. The function in intf[0] is called within a transaction, with
+// t as its first argument and the rest of intf as the remaining arguments. name
+// prefixes the errors returned. The bool returned is the result of t.End(), and
+// is false if the function was not called.
+func execTx(name string, t TX, level *int, intf []interface{}) (
+	retVal []reflect.Value, ended bool, err error) {
+	if len(intf) < 1 {
+		return retVal, false,
+			errors.New("[" + name + "] Exec: Must have atleast one argument")
+	}
+	fnPosInInterfaceArgs := 0
+	fn := reflect.ValueOf(intf[fnPosInInterfaceArgs]) // The function to call
+	if fn.Kind() != reflect.Func {
+		return retVal, false,
+			errors.New("[" + name + "] Exec: 1st argument must be a function")
+	}
+	fnType := fn.Type()
+	// Populate the arguments of the function correctly
+	argv := make([]reflect.Value, fnType.NumIn())
+	if len(argv) != len(intf) {
+		return retVal, false, errors.New("[" + name + "] Exec: Incorrect no. " +
+			"of args in function passed to Exec")
+	}
+	for i := range argv {
+		if i == fnPosInInterfaceArgs {
+			// Add the handle t as the 1st argument to be passed to the
+			// function fn. This is not passed by the application when it calls
+			// Exec().
+			argv[i] = reflect.ValueOf(t)
+		} else {
+			// get the arguments to the function call from the call to Exec()
+			// and populate in argv
+			if reflect.TypeOf(intf[i]) != fnType.In(i) {
+				return retVal, false, errors.New("[" + name + "] Exec: " +
+					"Incorrect type of args in function passed to Exec")
+			}
+			argv[i] = reflect.ValueOf(intf[i])
+		}
+	}
+	t.Begin()
+	txLevel := *level
+	retVal = fn.Call(argv)
+	if txLevel != *level {
+		err = errors.New("[" + name + "] Exec: Unbalanced Begin() & End() " +
+			"calls inside function passed to Exec")
+	}
+	return retVal, t.End(), err
+}
+
+// Release releases a transaction handle of a built-in kind, or of a registered
+// kind acquired through New().
 func Release(t TX) {
+	release := releaser(t)
+	if release == nil {
+		log.Panic("Releasing unsupported transaction!")
+	}
+	release(t)
+}
+
+// OldValue returns the value of the data pointed to by ptr as it was before the
+// ongoing transaction began. ptr must be a pointer. For undo transactions, the
+// value is read from the undo log. Redo transactions do not update data
+// in-place before commit, so the value is read from ptr itself.
+func OldValue(t TX, ptr interface{}) interface{} {
 	switch v := t.(type) {
 	case *undoTx:
-		releaseUndoTx(v)
-	case *redoTx:
-		releaseRedoTx(v)
+		return v.oldValue(ptr)
+	case *shadowTx:
+		return v.oldValue(ptr)
+	case *redoTx, *optimisticTx, *readTx, *resumableTx, *sharedTx, *subTx:
+		ptrV := reflect.ValueOf(ptr)
+		if ptrV.Kind() != reflect.Ptr {
+			panic("[redoTx] OldValue: Arg must be pointer")
+		}
+		return reflect.Indirect(ptrV).Interface()
 	default:
-		log.Panic("Releasing unsupported transaction!")
+		log.Panic("OldValue on unsupported transaction!")
 	}
+	return nil
 }
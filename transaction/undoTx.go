@@ -46,6 +46,8 @@ import (
 	"runtime"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -64,6 +66,10 @@ type (
 		// so that they will be found by the GC.
 		ptrArray []unsafe.Pointer
 
+		// ntStores is set when data is copied by Log2() using non-temporal
+		// stores, until they are fenced when the transaction ends.
+		ntStores bool
+
 		// tail position of the log where new data would be stored
 		tail int
 
@@ -86,6 +92,27 @@ type (
 		rlocks []*sync.RWMutex
 		wlocks []*sync.RWMutex
 		fs     flushSt
+
+		// Index of the handle within undoArray
+		index int
+
+		// Side log of data in volatile memory logged through Log3(). The
+		// copies of the logged data are stored back to back in volData. This
+		// log is only used to revert the updates if the transaction aborts at
+		// runtime. It is never persisted, as volatile data does not survive a
+		// crash.
+		volData    []byte
+		volEntries []volEntry
+
+		// Durability level of the ongoing transaction
+		durability int
+	}
+
+	// An entry in the volatile side log
+	volEntry struct {
+		ptr  unsafe.Pointer // address of the logged data
+		off  int            // offset of the copy of the data in volData
+		size uintptr
 	}
 
 	// Actual undo log data residing in persistent memory
@@ -95,7 +122,21 @@ type (
 		next   *uLogData
 	}
 
+	// A segment of undo log handles. The header holds the first segment. More
+	// segments are linked to the last one as the number of handles grows.
+	undoSegment struct {
+		logData [logNum]uLogData
+		next    *undoSegment
+	}
+
 	undoTxHeader struct {
+		magic int
+		seg   undoSegment
+	}
+
+	// Layout of the undo log header before the handles were split into
+	// segments, identified by legacyMagic
+	legacyUndoTxHeader struct {
 		magic   int
 		logData [logNum]uLogData
 	}
@@ -106,8 +147,15 @@ var (
 	undoArray   *bitmap
 	// zeroes is used to memset a cacheline size region of memory. It is sized
 	// at 128 bytes as we want a 64-byte aligned region somewhere inside zeroes.
-	zeroes   [128]byte
-	uHandles [logNum]undoTx
+	zeroes [128]byte
+	// Volatile metadata of the undo log handles, stored as a list of type
+	// []*[logNum]undoTx with one element per segment of handles.
+	uHandles atomic.Value
+	// The last segment of undo log handles in persistent memory
+	lastUndoSeg *undoSegment
+	// Maximum number of undo log handles, or 0 if there is no limit. Accessed
+	// atomically.
+	maxUndoHandles int64
 )
 
 const (
@@ -129,11 +177,13 @@ const (
  * so the application can store it in its pmem appRoot.
  */
 func initUndoTx(logHeadPtr unsafe.Pointer) unsafe.Pointer {
-	undoArray = newBitmap(logNum)
+	uHandles.Store([]*[logNum]undoTx(nil))
 	if logHeadPtr == nil {
 		// First time initialization
 		txHeaderPtr = pnew(undoTxHeader)
-		initUndoHandles()
+		initUndoSegment(&txHeaderPtr.seg)
+		addUndoHandles(&txHeaderPtr.seg)
+		lastUndoSeg = &txHeaderPtr.seg
 		// Write the magic constant after the transaction handles are persisted.
 		// NewUndoTx() can then check this constant to ensure all tx handles
 		// are properly initialized before releasing any.
@@ -141,35 +191,100 @@ func initUndoTx(logHeadPtr unsafe.Pointer) unsafe.Pointer {
 		runtime.PersistRange(unsafe.Pointer(&txHeaderPtr.magic), ptrSize)
 		logHeadPtr = unsafe.Pointer(txHeaderPtr)
 	} else {
+		if (*undoTxHeader)(logHeadPtr).magic == legacyMagic {
+			logHeadPtr = migrateUndoTx(logHeadPtr)
+		}
 		txHeaderPtr = (*undoTxHeader)(logHeadPtr)
 		if txHeaderPtr.magic != magic {
 			log.Fatal("undoTxHeader magic does not match!")
 		}
 
-		// Recover data from previous pending transactions, if any
-		for i := 0; i < logNum; i++ {
-			handle := &txHeaderPtr.logData[i]
-			uHandles[i].first = handle
-			uHandles[i].genNum = handle.genNum
-			uHandles[i].abort(false)
+		// Recover data from previous pending transactions, if any, in all
+		// segments of handles
+		for seg := &txHeaderPtr.seg; seg != nil; seg = seg.next {
+			handles := addUndoHandles(seg)
+			for i := range handles {
+				handles[i].abort(false)
+			}
+			lastUndoSeg = seg
 		}
 	}
 
+	undoArray = newBitmap(logNum)
+	for i := 1; i < len(uHandles.Load().([]*[logNum]undoTx)); i++ {
+		undoArray.addChunk()
+	}
+	undoArray.grow = growUndoHandles
 	return logHeadPtr
 }
 
-func initUndoHandles() {
+// migrateUndoTx copies the handles of an undo log header with the legacy layout
+// into a new header, whose pending transactions are then recovered as usual.
+// Both headers share the log buffers, so the legacy header stays usable if a
+// crash happens before the new header is stored in place of the legacy one.
+func migrateUndoTx(logHeadPtr unsafe.Pointer) unsafe.Pointer {
+	legacy := (*legacyUndoTxHeader)(logHeadPtr)
+	hdr := pnew(undoTxHeader)
+	hdr.seg.logData = legacy.logData
+	runtime.PersistRange(unsafe.Pointer(&hdr.seg), unsafe.Sizeof(hdr.seg))
+	hdr.magic = magic
+	runtime.PersistRange(unsafe.Pointer(&hdr.magic), ptrSize)
+	return unsafe.Pointer(hdr)
+}
+
+// initUndoSegment allocates the log buffers of a segment of undo log handles
+// and persists the segment.
+func initUndoSegment(seg *undoSegment) {
 	for i := 0; i < logNum; i++ {
-		handle := &txHeaderPtr.logData[i]
+		handle := &seg.logData[i]
 		handle.genNum = 1
 		handle.log = pmake([]byte, uLogInitSize)
-		uHandles[i].first = handle
-		uHandles[i].curr = handle
-		uHandles[i].genNum = 1
 	}
 
-	runtime.PersistRange(unsafe.Pointer(&txHeaderPtr.logData),
-		logNum*unsafe.Sizeof(txHeaderPtr.logData[0]))
+	runtime.PersistRange(unsafe.Pointer(seg), unsafe.Sizeof(*seg))
+}
+
+// addUndoHandles adds the volatile metadata for a segment of undo log handles
+// and returns it.
+func addUndoHandles(seg *undoSegment) *[logNum]undoTx {
+	old := uHandles.Load().([]*[logNum]undoTx)
+	handles := new([logNum]undoTx)
+	for i := range handles {
+		handle := &seg.logData[i]
+		handles[i].index = len(old)*logNum + i
+		handles[i].first = handle
+		handles[i].curr = handle
+		handles[i].genNum = handle.genNum
+	}
+	segs := make([]*[logNum]undoTx, len(old)+1)
+	copy(segs, old)
+	segs[len(old)] = handles
+	uHandles.Store(segs)
+	return handles
+}
+
+// growUndoHandles adds a segment of undo log handles, unless the maximum number
+// of handles has been reached. The new segment is initialized and persisted
+// before it is linked to the last segment, so a crash leaves either no new
+// segment or a fully initialized one.
+func growUndoHandles() bool {
+	n := len(uHandles.Load().([]*[logNum]undoTx)) * logNum
+	if max := atomic.LoadInt64(&maxUndoHandles); max > 0 && int64(n) >= max {
+		return false
+	}
+	seg := pnew(undoSegment)
+	initUndoSegment(seg)
+	lastUndoSeg.next = seg
+	runtime.PersistRange(unsafe.Pointer(&lastUndoSeg.next), ptrSize)
+	lastUndoSeg = seg
+	addUndoHandles(seg)
+	return true
+}
+
+// undoHandle returns the undo log handle at index 'i'
+func undoHandle(i int) *undoTx {
+	segs := uHandles.Load().([]*[logNum]undoTx)
+	return &segs[i/logNum][i%logNum]
 }
 
 func NewUndoTx() TX {
@@ -177,7 +292,34 @@ func NewUndoTx() TX {
 		log.Fatal("Undo log not correctly initialized!")
 	}
 	index := undoArray.nextAvailable()
-	return &uHandles[index]
+	return undoHandle(index)
+}
+
+// TryNewUndoTx returns an undo transaction handle if one is available, and
+// returns ErrNoHandle otherwise. It never blocks.
+func TryNewUndoTx() (TX, error) {
+	if txHeaderPtr == nil || txHeaderPtr.magic != magic {
+		log.Fatal("Undo log not correctly initialized!")
+	}
+	index := undoArray.tryNextAvailable()
+	if index < 0 {
+		return nil, ErrNoHandle
+	}
+	return undoHandle(index), nil
+}
+
+// NewUndoTxTimeout returns an undo transaction handle, waiting for up to
+// 'timeout' for one to be released if none is available. It returns
+// ErrNoHandle if no handle was available within that time.
+func NewUndoTxTimeout(timeout time.Duration) (TX, error) {
+	if txHeaderPtr == nil || txHeaderPtr.magic != magic {
+		log.Fatal("Undo log not correctly initialized!")
+	}
+	index := undoArray.nextAvailableTimeout(timeout)
+	if index < 0 {
+		return nil, ErrNoHandle
+	}
+	return undoHandle(index), nil
 }
 
 func releaseUndoTx(t *undoTx) {
@@ -185,9 +327,7 @@ func releaseUndoTx(t *undoTx) {
 	// Reset the pointers in the log entries, but need not allocate a new
 	// backing array
 	t.abort(false)
-	index := (uintptr(unsafe.Pointer(t)) - uintptr(unsafe.Pointer(&uHandles[0]))) /
-		unsafe.Sizeof(uHandles[0])
-	undoArray.clearBit(int(index))
+	undoArray.clearBit(t.index)
 }
 
 func (t *undoTx) setTail(tail int) {
@@ -200,6 +340,14 @@ func (t *undoTx) setTail(tail int) {
 func (t *undoTx) resetLogData() {
 	t.curr = t.first
 	t.tail = 0
+	t.ntStores = false
+
+	// Drop the volatile side log
+	for i := range t.volEntries {
+		t.volEntries[i].ptr = nil
+	}
+	t.volEntries = t.volEntries[:0]
+	t.volData = t.volData[:0]
 
 	// Zero out ptrArray
 	len := len(t.ptrArray)
@@ -270,9 +418,13 @@ func (t *undoTx) ReadLog(intf ...interface{}) (retVal interface{}) {
 	}
 	ptrV := reflect.ValueOf(intf[0])
 	switch ptrV.Kind() {
+	case reflect.UnsafePointer:
+		// Raw read of data logged through Log3(). Undo updates are in-place.
+		retVal = intf[0]
 	case reflect.Ptr:
-		data := reflect.Indirect(ptrV)
-		retVal = data.Interface()
+		// Read through the updates of deferred redo transactions which are
+		// not applied yet, if any.
+		retVal = readThroughPtr(ptrV)
 	default:
 		panic("[undoTx] ReadLog: Arg must be pointer")
 	}
@@ -292,9 +444,105 @@ func (t *undoTx) readSlice(slicePtr interface{}, stIndex int,
 	return s.Slice(stIndex, endIndex).Interface()
 }
 
+// oldValue returns the value of the data pointed to by 'ptr' as it was before
+// the transaction began. The data is first read in-place, and then any part of
+// it found in the log is overwritten with the logged copy. Log entries are
+// applied from last to first, so the earliest logged copy of each byte is the
+// one returned.
+// The bytes are assembled in an untyped buffer, and the value is then built
+// from it using a typed copy, so that the garbage collector sees every pointer
+// stored in the value. Until then, the objects the logged pointers refer to are
+// kept alive by ptrArray. Only entries of the ongoing transaction are read, so
+// the logged pointers are from this run and never need swizzling.
+func (t *undoTx) oldValue(ptr interface{}) interface{} {
+	ptrV := reflect.ValueOf(ptr)
+	if ptrV.Kind() != reflect.Ptr {
+		panic("[undoTx] OldValue: Arg must be pointer")
+	}
+	typ := ptrV.Type().Elem()
+	start := ptrV.Pointer()
+	end := start + typ.Size()
+	if typ.Size() == 0 {
+		return reflect.Zero(typ).Interface()
+	}
+	// The buffer is made of words, so that it is aligned for any type
+	words := make([]uintptr, (typ.Size()+ptrSize-1)/ptrSize)
+	retData := (*[maxInt]byte)(unsafe.Pointer(&words[0]))
+	copy(retData[:typ.Size()], (*[maxInt]byte)(unsafe.Pointer(start))[:typ.Size()])
+
+	undoEntries := t.logEntries(false)
+	for j := len(undoEntries) - 1; j >= 0; j-- {
+		entry := undoEntries[j]
+		size := *(*uintptr)(unsafe.Pointer(entry))
+		origPtr := *(*uintptr)(unsafe.Pointer(entry + ptrSize))
+		lo := origPtr
+		if lo < start {
+			lo = start
+		}
+		hi := origPtr + size
+		if hi > end {
+			hi = end
+		}
+		if lo >= hi {
+			// This entry does not overlap with the data being read
+			continue
+		}
+		logData := (*[maxInt]byte)(unsafe.Pointer(entry + 16 + lo - origPtr))
+		copy(retData[lo-start:hi-start], logData[:hi-lo])
+	}
+	for j := len(t.volEntries) - 1; j >= 0; j-- {
+		e := t.volEntries[j]
+		origPtr := uintptr(e.ptr)
+		lo := origPtr
+		if lo < start {
+			lo = start
+		}
+		hi := origPtr + e.size
+		if hi > end {
+			hi = end
+		}
+		if lo >= hi {
+			continue
+		}
+		off := e.off + int(lo-origPtr)
+		copy(retData[lo-start:hi-start], t.volData[off:off+int(hi-lo)])
+	}
+	retVal := reflect.New(typ).Elem()
+	retVal.Set(reflect.NewAt(typ, unsafe.Pointer(&words[0])).Elem())
+	return retVal.Interface()
+}
+
+// logVolatile copies 'size' bytes of volatile data starting at 'src' to the
+// volatile side log. Nothing is flushed, as these updates need not survive a
+// crash.
+func (t *undoTx) logVolatile(src unsafe.Pointer, size uintptr) {
+	// Create a volatile copy of all pointers in this object.
+	t.ptrArray = runtime.CollectPtrs(uintptr(src), int(size), t.ptrArray)
+	off := len(t.volData)
+	t.volData = append(t.volData, (*[maxInt]byte)(src)[:size:size]...)
+	t.volEntries = append(t.volEntries, volEntry{src, off, size})
+}
+
 // Log3 logs data in a linked list of byte arrays. 'src' is the pointer to the
-// data to be logged and 'size' is the number of bytes to log.
+// data to be logged and 'size' is the number of bytes to log. Data in volatile
+// memory is logged in a volatile side log instead, which is used only if the
+// transaction aborts at runtime. A transaction with durability "none" can only
+// log data in volatile memory, and ErrVolatileOnly is returned otherwise.
 func (t *undoTx) Log3(src unsafe.Pointer, size uintptr) error {
+	if err := t.lockRange(src, size); err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	inPmem := runtime.InPmem(uintptr(src))
+	if t.durability == durNone && inPmem {
+		return ErrVolatileOnly
+	}
+	if !inPmem {
+		t.logVolatile(src, size)
+		return nil
+	}
 	uData := t.curr
 	tail := t.tail
 
@@ -370,14 +618,61 @@ func (t *undoTx) Log3(src unsafe.Pointer, size uintptr) error {
 		tail += cacheSize
 	}
 
-	runtime.Fence() // Fence after movnt
+	fence() // Fence after movnt
 	t.tail = tail
 
 	return nil
 }
 
+// Log2 is a failure-atomic memcpy. It logs the current contents of 'dst' and
+// then copies 'size' bytes from 'src' to 'dst' using non-temporal stores. 'src'
+// and 'dst' may overlap. The copied data is made durable when the outermost
+// transaction ends, and is reverted if the transaction aborts.
 func (t *undoTx) Log2(src, dst unsafe.Pointer, size uintptr) error {
-	log.Fatal("Log2() not implemented")
+	if size == 0 {
+		return nil
+	}
+	if err := t.Log3(dst, size); err != nil {
+		return err
+	}
+
+	// The pointers being copied into dst may not be reachable from anywhere
+	// else if src gets overwritten. Keep a volatile copy of them until the
+	// transaction ends so that they are not garbage collected.
+	t.ptrArray = runtime.CollectPtrs(uintptr(src), int(size), t.ptrArray)
+
+	srcU := uintptr(src)
+	dstU := uintptr(dst)
+	if srcU < dstU+size && dstU < srcU+size {
+		// movnt copies forward, so overlapping regions are first staged in a
+		// volatile buffer to avoid overwriting source bytes not yet copied.
+		buf := make([]byte, size)
+		copy(buf, (*[maxInt]byte)(src)[:size])
+		src = unsafe.Pointer(&buf[0])
+	}
+	movnt(dst, src, size)
+	t.ntStores = true
+	return nil
+}
+
+// LogRange logs the range of elements of 'slice' starting at index 'start', and
+// then copies the elements of 'elems' into that range. 'slice' can be a slice
+// or a pointer to a slice.
+func (t *undoTx) LogRange(slice interface{}, start int, elems interface{}) error {
+	sV := reflect.Indirect(reflect.ValueOf(slice))
+	eV := reflect.ValueOf(elems)
+	if err := checkRange(sV, start, eV); err != nil {
+		return err
+	}
+	n := eV.Len()
+	if n == 0 {
+		return nil
+	}
+	size := uintptr(n) * sV.Type().Elem().Size()
+	if err := t.Log3(unsafe.Pointer(sV.Index(start).UnsafeAddr()), size); err != nil {
+		return err
+	}
+	reflect.Copy(sV.Slice(start, start+n), eV)
 	return nil
 }
 
@@ -573,7 +868,24 @@ func (t *undoTx) Exec(intf ...interface{}) (retVal []reflect.Value, err error) {
 	return retVal, err
 }
 
-func (t *undoTx) Begin() error {
+// Begin starts a transaction. The durability level of the transaction can be
+// given as "sync" or "none" when the outermost transaction begins. Nested
+// transactions have the durability level of the outermost transaction.
+func (t *undoTx) Begin(d ...Durability) error {
+	code, err := durabilityCode(d)
+	if err != nil {
+		return errors.New("[undoTx] " + err.Error())
+	}
+	if code == durDeferred {
+		return errors.New("[undoTx] Begin: Deferred durability is only " +
+			"supported by redo transactions")
+	}
+	if t.level == 0 {
+		t.durability = code
+	} else if len(d) > 0 && code != t.durability {
+		return errors.New("[undoTx] Begin: Durability level of a nested " +
+			"transaction must match the outermost transaction")
+	}
 	t.level++
 	return nil
 }
@@ -592,10 +904,18 @@ func (t *undoTx) End() bool {
 	t.level--
 	if t.level == 0 {
 		defer t.unLock()
-		t.fs.flushAndDestroy()
-		t.genNum++
-		t.first.genNum = t.genNum
-		runtime.PersistRange(unsafe.Pointer(&t.first.genNum), 8)
+		if t.durability == durNone {
+			// Only data in volatile memory was updated, and logged in the
+			// volatile side log, so there is nothing to persist.
+			t.resetLogData()
+			return true
+		}
+		if window, ok := groupCommitWindow(); ok {
+			groupCommit(&t.fs, t.nextGen, window, t.ntStores)
+		} else {
+			t.fs.flushAndDestroy()
+			persist(t.nextGen())
+		}
 		t.resetLogData() // discard all logs.
 		return true
 	}
@@ -603,32 +923,69 @@ func (t *undoTx) End() bool {
 	return false
 }
 
-func (t *undoTx) RLock(m *sync.RWMutex) {
-	m.RLock()
-	t.rlocks = append(t.rlocks, m)
+// nextGen moves the log to the next generation, which invalidates all entries
+// in the log. It returns the range to be persisted for this to be durable.
+func (t *undoTx) nextGen() (unsafe.Pointer, uintptr) {
+	t.genNum++
+	t.first.genNum = t.genNum
+	return unsafe.Pointer(&t.first.genNum), 8
+}
+
+func (t *undoTx) RLock(m *sync.RWMutex) error {
+	if !rLock(&t.rlocks, &t.wlocks, m) {
+		t.abort(false)
+		return ErrDeadlock
+	}
+	return nil
+}
+
+func (t *undoTx) WLock(m *sync.RWMutex) error {
+	if !wLock(&t.rlocks, &t.wlocks, m) {
+		t.abort(false)
+		return ErrDeadlock
+	}
+	return nil
 }
 
-func (t *undoTx) WLock(m *sync.RWMutex) {
-	m.Lock()
-	t.wlocks = append(t.wlocks, m)
+func (t *undoTx) Lock(m *sync.RWMutex) error {
+	return t.WLock(m)
 }
 
-func (t *undoTx) Lock(m *sync.RWMutex) {
-	t.WLock(m)
+func (t *undoTx) LockAll(ms ...*sync.RWMutex) error {
+	if !lockAll(&t.rlocks, &t.wlocks, ms) {
+		t.abort(false)
+		return ErrDeadlock
+	}
+	return nil
 }
 
-func (t *undoTx) unLock() {
-	for i, m := range t.wlocks {
-		m.Unlock()
-		t.wlocks[i] = nil
+// Read acquires the read locks in the range lock table covering 'size' bytes
+// starting at 'ptr'. It does nothing if range locking is disabled.
+func (t *undoTx) Read(ptr unsafe.Pointer, size uintptr) error {
+	if !rangeLock(&t.rlocks, &t.wlocks, ptr, size, false) {
+		t.abort(false)
+		return ErrDeadlock
 	}
-	t.wlocks = t.wlocks[:0]
+	return nil
+}
 
-	for i, m := range t.rlocks {
-		m.RUnlock()
-		t.rlocks[i] = nil
+// lockRange acquires the write locks in the range lock table covering 'size'
+// bytes starting at 'ptr'. It does nothing if range locking is disabled. It
+// returns ErrPrepared if the range is updated by a prepared transaction found
+// during recovery.
+func (t *undoTx) lockRange(ptr unsafe.Pointer, size uintptr) error {
+	if err := checkPrepared(ptr, size); err != nil {
+		return err
+	}
+	if !rangeLock(&t.rlocks, &t.wlocks, ptr, size, true) {
+		t.abort(false)
+		return ErrDeadlock
 	}
-	t.rlocks = t.rlocks[:0]
+	return nil
+}
+
+func (t *undoTx) unLock() {
+	unlockAll(&t.rlocks, &t.wlocks)
 }
 
 // abort() aborts the ongoing undo transaction. It reverts the changes made by
@@ -638,13 +995,56 @@ func (t *undoTx) unLock() {
 func (t *undoTx) abort(swizzle bool) error {
 	defer t.unLock()
 	t.level = 0
-	uData := t.first
 
 	// Aborting log entries has to be done from last to first. Since this is
 	// difficult when using a linked list of array, undoEntries first builds
 	// a list of pointers at which each entry begins. These are then aborted in
 	// the inverse order in the next step
+	undoEntries := t.logEntries(swizzle)
+
+	for j := len(undoEntries) - 1; j >= 0; j-- {
+		entry := undoEntries[j]
+		size := *(*uintptr)(unsafe.Pointer(entry))
+		origPtr := *(*uintptr)(unsafe.Pointer(entry + ptrSize))
+		if swizzle {
+			origPtr = runtime.SwizzlePointer(origPtr)
+		}
+		if !runtime.InPmem(origPtr) {
+			// Data in volatile memory is logged in the volatile side log. If
+			// an older log has such an entry, the data did not survive the
+			// restart, so the entry is dropped.
+			continue
+		}
+		dataPtr := unsafe.Pointer(entry + 16)
+		origData := (*[maxInt]byte)(unsafe.Pointer(origPtr))
+		logData := (*[maxInt]byte)(dataPtr)
+		copy(origData[:size], logData[:])
+		runtime.FlushRange(unsafe.Pointer(origPtr), size)
+	}
+	runtime.Fence()
+
+	// Revert the updates to volatile data. The side log is empty if abort is
+	// called during Init.
+	for j := len(t.volEntries) - 1; j >= 0; j-- {
+		e := t.volEntries[j]
+		origData := (*[maxInt]byte)(e.ptr)
+		copy(origData[:e.size], t.volData[e.off:e.off+int(e.size)])
+	}
+
+	t.first.genNum++
+	runtime.PersistRange(unsafe.Pointer(&t.first.genNum), ptrSize)
+	t.genNum = t.first.genNum
+	t.resetLogData()
+	return nil
+}
+
+// logEntries walks the linked list of undo log buffers and returns the
+// location of the size field of every valid log entry, in the order in which
+// the entries were logged. swizzle indicates if pointers has to be swizzled
+// before being dereferenced.
+func (t *undoTx) logEntries(swizzle bool) []uintptr {
 	var undoEntries []uintptr
+	uData := t.first
 
 	for uData != nil {
 		off := 0
@@ -678,56 +1078,38 @@ func (t *undoTx) abort(swizzle bool) error {
 			uData = (*uLogData)(unsafe.Pointer(runtime.SwizzlePointer(uDatap)))
 		}
 	}
-
-	for j := len(undoEntries) - 1; j >= 0; j-- {
-		entry := undoEntries[j]
-		size := *(*uintptr)(unsafe.Pointer(entry))
-		origPtr := *(*uintptr)(unsafe.Pointer(entry + ptrSize))
-		if swizzle {
-			origPtr = runtime.SwizzlePointer(origPtr)
-		}
-		dataPtr := unsafe.Pointer(entry + 16)
-		origData := (*[maxInt]byte)(unsafe.Pointer(origPtr))
-		logData := (*[maxInt]byte)(dataPtr)
-		copy(origData[:size], logData[:])
-		runtime.FlushRange(unsafe.Pointer(origPtr), size)
-	}
-	runtime.Fence()
-
-	t.first.genNum++
-	runtime.PersistRange(unsafe.Pointer(&t.first.genNum), ptrSize)
-	t.genNum = t.first.genNum
-	t.resetLogData()
-	return nil
+	return undoEntries
 }
 
 // If runtime needs to do pointer swizzling duing initilization, then undo log
 // entries need to be reverted before doing pointer swizzling. This function is
-// registered as a callback with the runtime, and will be called before pointers
-// are swizzled. rootPtr is the swizzled root pointer set by the application.
-func SwizzleAndAbort(rootPtr unsafe.Pointer) {
-	// pmemHeader definition is not available here.
-	type pmh struct {
-		undoTxHeadPtr unsafe.Pointer
-		redoTxHeadPtr unsafe.Pointer
-		appData       []int // namedObject definition not available here
-	}
-	appRootPtr := (*pmh)(rootPtr)
-	undoTxSwizzled := runtime.SwizzlePointer(uintptr(unsafe.Pointer(appRootPtr.undoTxHeadPtr)))
-	undoTxHeadPtr := (*undoTxHeader)(unsafe.Pointer(undoTxSwizzled))
+// called by SwizzleAndAbort before pointers are swizzled. logHeadPtr is the
+// swizzled pointer to the undo log header.
+func swizzleAndAbortUndo(logHeadPtr unsafe.Pointer) {
+	undoTxHeadPtr := (*undoTxHeader)(logHeadPtr)
 
 	// Check if the magic number matches
-	if undoTxHeadPtr.magic != magic {
+	legacy := undoTxHeadPtr.magic == legacyMagic
+	if undoTxHeadPtr.magic != magic && !legacy {
 		log.Fatal("undoTxHeader magic does not match!")
 	}
 
-	for i := 0; i < logNum; i++ {
-		handle := &undoTxHeadPtr.logData[i]
-		uHandles[i].first = handle
-		uHandles[i].genNum = handle.genNum
-		// Reallocate the array for the log entries. TODO: How does this
-		// change with tail not in pmem?
-		uHandles[i].abort(true)
+	uHandles.Store([]*[logNum]undoTx(nil))
+	seg := &undoTxHeadPtr.seg
+	for {
+		handles := addUndoHandles(seg)
+		for i := range handles {
+			// Reallocate the array for the log entries. TODO: How does this
+			// change with tail not in pmem?
+			handles[i].abort(true)
+		}
+		// A legacy header holds only the handles of the first segment, and
+		// no link to a next segment.
+		if legacy || seg.next == nil {
+			break
+		}
+		segSwizzled := runtime.SwizzlePointer(uintptr(unsafe.Pointer(seg.next)))
+		seg = (*undoSegment)(unsafe.Pointer(segSwizzled))
 	}
 
 }
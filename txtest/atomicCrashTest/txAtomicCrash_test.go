@@ -0,0 +1,69 @@
+// +build crash
+
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+// This test needs to be run twice to check that the atomic operations persist
+// their updates before returning. Hence this test is not run by default and
+// will only be run if a flag 'crash' is specified while running the tests.
+//
+// E.g.: ~/go-pmem/bin/go test -tags="crash" -v # run 1
+// E.g.: ~/go-pmem/bin/go test -tags="crash" -v # run 2
+
+package atomicCrashTest
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type atomicSt struct {
+	counter uint64
+	state   uint64
+	ptr     unsafe.Pointer
+}
+
+// This test makes sure that the updates made by the atomic operations are
+// persistent as soon as the operations return, without any transaction.
+func TestAtomicCrash(t *testing.T) {
+	firstInit := pmem.Init("atomicTestFile")
+	var st1 *atomicSt
+	if firstInit {
+		st1 = (*atomicSt)(pmem.New("atomic1", st1))
+		var val *int
+		val = (*int)(pmem.New("atomicVal", val))
+		*val = 42
+		runtime.PersistRange(unsafe.Pointer(val), unsafe.Sizeof(*val))
+		transaction.AtomicStore64(&st1.counter, 100)
+		for i := 0; i < 10; i++ {
+			transaction.AtomicAdd64(&st1.counter, 1)
+		}
+		transaction.AtomicCAS64(&st1.state, 0, 1)
+		transaction.AtomicCAS64(&st1.state, 0, 2) // fails
+		transaction.AtomicStorePointer(&st1.ptr, unsafe.Pointer(val))
+		fmt.Println("[TestAtomicCrash]: Crashing now")
+		return // <-- return without ending cleanly to simulate CRASH!
+	} else {
+		fmt.Println("Testing atomic operations after crash")
+		st1 = (*atomicSt)(pmem.Get("atomic1", st1))
+		if st1.counter != 110 {
+			t.Errorf("want = %d, got = %d", 110, st1.counter)
+		}
+		if st1.state != 1 {
+			t.Errorf("want = %d, got = %d", 1, st1.state)
+		}
+		if st1.ptr == nil || *(*int)(st1.ptr) != 42 {
+			t.Errorf("Pointer stored by AtomicStorePointer was lost")
+		}
+		fmt.Println("[TestAtomicCrash] successful")
+		os.Remove("atomicTestFile")
+	}
+}
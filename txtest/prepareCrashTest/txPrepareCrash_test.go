@@ -0,0 +1,83 @@
+// +build crash
+
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+// This test needs to be run twice to check that prepared transactions survive
+// a crash undecided. Hence this test is not run by default and will only be
+// run if a flag 'crash' is specified while running the tests.
+//
+// E.g.: ~/go-pmem/bin/go test -tags="crash" -v # run 1
+// E.g.: ~/go-pmem/bin/go test -tags="crash" -v # run 2
+
+package prepareCrashTest
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type prepareSt struct {
+	a int
+	b int
+	c int
+}
+
+// This test makes sure that recovery neither applies nor drops the log of a
+// prepared transaction, that the data it updates cannot be updated by other
+// transactions till its outcome is decided, and that it can be committed or
+// aborted after the restart.
+func TestPrepareCrash(t *testing.T) {
+	firstInit := pmem.Init("prepareTestFile")
+	var st1 *prepareSt
+	if firstInit {
+		st1 = (*prepareSt)(pmem.New("prepare1", st1))
+		tx := transaction.NewRedoTx()
+		tx.Begin()
+		tx.Log(&st1.a, 10)
+		transaction.Prepare(tx, "xid-commit")
+		tx = transaction.NewRedoTx()
+		tx.Begin()
+		tx.Log(&st1.b, 20)
+		transaction.Prepare(tx, "xid-abort")
+		fmt.Println("[TestPrepareCrash]: Crashing now")
+		return // <-- return before deciding the outcome to simulate CRASH!
+	} else {
+		fmt.Println("Testing prepared transactions after crash")
+		st1 = (*prepareSt)(pmem.Get("prepare1", st1))
+		ids := transaction.PreparedTxs()
+		if len(ids) != 2 || ids[0] != "xid-abort" || ids[1] != "xid-commit" {
+			t.Fatalf("want = [xid-abort xid-commit], got = %v", ids)
+		}
+		if st1.a != 0 || st1.b != 0 {
+			t.Errorf("Prepared updates applied by recovery")
+		}
+		tx := transaction.NewRedoTx()
+		tx.Begin()
+		if err := tx.Log(&st1.a, 30); err != transaction.ErrPrepared {
+			t.Errorf("want = %v, got = %v", transaction.ErrPrepared, err)
+		}
+		if err := tx.Log(&st1.c, 30); err != nil {
+			t.Errorf("want = nil, got = %v", err)
+		}
+		tx.End()
+		transaction.Release(tx)
+		if err := transaction.CommitPrepared("xid-commit"); err != nil {
+			t.Fatal(err)
+		}
+		if err := transaction.AbortPrepared("xid-abort"); err != nil {
+			t.Fatal(err)
+		}
+		if st1.a != 10 || st1.b != 0 || st1.c != 30 {
+			t.Errorf("want = {10 0 30}, got = %v", *st1)
+		}
+		fmt.Println("[TestPrepareCrash] successful")
+		os.Remove("prepareTestFile")
+	}
+}
@@ -0,0 +1,76 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type atomicWords struct {
+	counter uint64
+	state   uint64
+	ptr     unsafe.Pointer
+}
+
+func TestAtomicOps(t *testing.T) {
+	w := pnew(atomicWords)
+
+	fmt.Println("Testing AtomicStore64, AtomicAdd64 and AtomicCAS64")
+	transaction.AtomicStore64(&w.counter, 10)
+	assertEqual(t, w.counter, uint64(10))
+	assertEqual(t, transaction.AtomicAdd64(&w.counter, 5), uint64(15))
+	assertEqual(t, transaction.AtomicAdd64(&w.counter, ^uint64(0)), uint64(14))
+	assertEqual(t, transaction.AtomicCAS64(&w.state, 1, 2), false)
+	assertEqual(t, w.state, uint64(0))
+	assertEqual(t, transaction.AtomicCAS64(&w.state, 0, 2), true)
+	assertEqual(t, w.state, uint64(2))
+
+	fmt.Println("Testing AtomicStorePointer")
+	a := pnew(int)
+	*a = 20
+	transaction.AtomicStorePointer(&w.ptr, unsafe.Pointer(a))
+	assertEqual(t, *(*int)(w.ptr), 20)
+	transaction.AtomicStorePointer(&w.ptr, nil)
+	assertEqual(t, w.ptr, unsafe.Pointer(nil))
+
+	fmt.Println("Testing concurrent atomic operations")
+	w.counter = 0
+	w.state = 0
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				transaction.AtomicAdd64(&w.counter, 1)
+				for {
+					old := atomic.LoadUint64(&w.state)
+					if transaction.AtomicCAS64(&w.state, old, old+1) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, w.counter, uint64(8000))
+	assertEqual(t, w.state, uint64(8000))
+
+	fmt.Println("Testing atomic operations on unaligned address")
+	defer func() {
+		if recover() == nil {
+			t.Error("Unaligned atomic store did not panic")
+		}
+	}()
+	buf := pmake([]byte, 16)
+	transaction.AtomicStore64((*uint64)(unsafe.Pointer(&buf[1])), 1)
+}
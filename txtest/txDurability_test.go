@@ -0,0 +1,119 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+func TestDurabilityLevels(t *testing.T) {
+	a := pnew(int)
+	b := pnew(int)
+
+	fmt.Println("Testing invalid durability levels")
+	redoTx := transaction.NewRedoTx()
+	assertEqual(t, redoTx.Begin("eventual") != nil, true)
+	assertEqual(t, redoTx.Begin("sync", "none") != nil, true)
+	undoTx := transaction.NewUndoTx()
+	assertEqual(t, undoTx.Begin(transaction.DurabilityDeferred) != nil, true)
+	optTx := transaction.NewOptimisticTx()
+	assertEqual(t, optTx.Begin(transaction.DurabilityNone) != nil, true)
+	transaction.Release(optTx)
+
+	fmt.Println("Testing nested transaction durability")
+	assertEqual(t, redoTx.Begin(transaction.DurabilitySync), nil)
+	assertEqual(t, redoTx.Begin(transaction.DurabilityNone) != nil, true)
+	assertEqual(t, redoTx.Begin(), nil)
+	redoTx.End()
+	redoTx.End()
+
+	fmt.Println("Testing redo transaction with deferred durability")
+	m := new(sync.RWMutex)
+	assertEqual(t, redoTx.Begin(transaction.DurabilityDeferred), nil)
+	redoTx.WLock(m)
+	redoTx.Log(a, 10)
+	redoTx.Log(b, 20)
+	assertEqual(t, redoTx.End(), true)
+	// The updates are read through until they are applied
+	readTx := transaction.NewReadTx()
+	readTx.Begin()
+	assertEqual(t, readTx.ReadLog(a), 10)
+	assertEqual(t, readTx.ReadLog(b), 20)
+	readTx.End()
+	transaction.Release(readTx)
+	// The lock is released once the updates are applied
+	m.Lock()
+	assertEqual(t, *a, 10)
+	assertEqual(t, *b, 20)
+	m.Unlock()
+	// Beginning again waits for the earlier updates to be applied
+	redoTx.Begin("deferred")
+	redoTx.Log(a, 30)
+	redoTx.End()
+	redoTx.Begin()
+	assertEqual(t, *a, 30)
+	assertEqual(t, redoTx.ReadLog(a), 30)
+	redoTx.End()
+	redoTx.Begin("deferred")
+	redoTx.Log(b, 40)
+	redoTx.End()
+	transaction.Release(redoTx) // waits for the updates to be applied
+	assertEqual(t, *b, 40)
+
+	fmt.Println("Testing redo transaction with no durability")
+	v := new(int) // in volatile memory
+	redoTx = transaction.NewRedoTx()
+	redoTx.Begin(transaction.DurabilityNone)
+	redoTx.Log(v, 50)
+	assertEqual(t, *v, 0)
+	assertEqual(t, redoTx.Log(a, 50), transaction.ErrVolatileOnly)
+	assertEqual(t, redoTx.Log3(unsafe.Pointer(a), intSize),
+		transaction.ErrVolatileOnly)
+	redoTx.End()
+	assertEqual(t, *v, 50)
+	assertEqual(t, *a, 30)
+	transaction.Release(redoTx)
+
+	fmt.Println("Testing undo transaction with no durability")
+	assertEqual(t, undoTx.Begin(transaction.DurabilityNone), nil)
+	assertEqual(t, undoTx.Log3(unsafe.Pointer(a), intSize),
+		transaction.ErrVolatileOnly)
+	undoTx.Log3(unsafe.Pointer(v), intSize)
+	*v = 60
+	undoTx.End()
+	assertEqual(t, *v, 60)
+	undoTx.Begin("none")
+	undoTx.Log3(unsafe.Pointer(v), intSize)
+	*v = 70
+	transaction.Release(undoTx)
+	assertEqual(t, *v, 60)
+
+	fmt.Println("Testing concurrent deferred transactions")
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx := transaction.NewRedoTx()
+			for i := 0; i < 100; i++ {
+				tx.Begin("deferred")
+				tx.WLock(m)
+				tx.Log(a, tx.ReadLog(a).(int)+1)
+				tx.End()
+			}
+			transaction.Release(tx)
+		}()
+	}
+	wg.Wait()
+	m.Lock()
+	assertEqual(t, *a, 830)
+	m.Unlock()
+}
@@ -0,0 +1,114 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+// Runs small redo transactions from concurrent goroutines, with and without
+// group commit, and reports the fences and cachelines flushed per transaction.
+func BenchmarkGroupCommitFences(b *testing.B) {
+	for _, window := range []time.Duration{0, 50 * time.Microsecond} {
+		name := "NoGroup"
+		if window > 0 {
+			name = "Group"
+		}
+		b.Run(name, func(b *testing.B) {
+			transaction.SetGroupCommit(window)
+			defer transaction.SetGroupCommit(0)
+			counts := pmake([]int, 8*runtime.GOMAXPROCS(0))
+			var next int32
+			fences := transaction.FenceCount()
+			flushes := transaction.FlushCount()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine updates its own cacheline
+				c := &counts[8*int(atomic.AddInt32(&next, 1)-1)]
+				tx := transaction.NewRedoTx()
+				for pb.Next() {
+					tx.Begin()
+					tx.Log(c, *c+1)
+					tx.End()
+				}
+				transaction.Release(tx)
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(transaction.FenceCount()-fences)/
+				float64(b.N), "fences/tx")
+			b.ReportMetric(float64(transaction.FlushCount()-flushes)/
+				float64(b.N), "flushes/tx")
+		})
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	transaction.SetGroupCommit(100 * time.Microsecond)
+	defer transaction.SetGroupCommit(0)
+
+	fmt.Println("Testing group commit of a single transaction")
+	a := pnew(int)
+	tx := transaction.NewUndoTx()
+	tx.Begin()
+	tx.Log3(unsafe.Pointer(a), intSize)
+	*a = 10
+	assertEqual(t, tx.End(), true)
+	assertEqual(t, *a, 10)
+	transaction.Release(tx)
+	tx = transaction.NewRedoTx()
+	tx.Begin()
+	tx.Log(a, 20)
+	assertEqual(t, tx.End(), true)
+	assertEqual(t, *a, 20)
+	transaction.Release(tx)
+
+	fmt.Println("Testing group commit of concurrent transactions")
+	const goroutines = 16
+	const txPerGoroutine = 100
+	counts := pmake([]int, 2*goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			utx := transaction.NewUndoTx()
+			rtx := transaction.NewRedoTx()
+			for i := 0; i < txPerGoroutine; i++ {
+				utx.Begin()
+				utx.Log3(unsafe.Pointer(&counts[2*g]), intSize)
+				counts[2*g]++
+				utx.End()
+
+				rtx.Begin()
+				rtx.Log(&counts[2*g+1], counts[2*g+1]+1)
+				rtx.End()
+			}
+			transaction.Release(utx)
+			transaction.Release(rtx)
+		}(g)
+	}
+	wg.Wait()
+	for i := range counts {
+		assertEqual(t, counts[i], txPerGoroutine)
+	}
+
+	fmt.Println("Testing abort after group commit is disabled")
+	transaction.SetGroupCommit(0)
+	tx = transaction.NewUndoTx()
+	tx.Begin()
+	tx.Log3(unsafe.Pointer(a), intSize)
+	*a = 30
+	transaction.Release(tx)
+	assertEqual(t, *a, 20)
+}
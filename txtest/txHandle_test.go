@@ -0,0 +1,177 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+func TestUndoTxNoHandle(t *testing.T) {
+	transaction.SetMaxHandles("undo", 512)
+	defer transaction.SetMaxHandles("undo", 0)
+	fmt.Println("Testing TryNewUndoTx when all handles are in use")
+	var handles []transaction.TX
+	for {
+		tx, err := transaction.TryNewUndoTx()
+		if err != nil {
+			assertEqual(t, err, transaction.ErrNoHandle)
+			break
+		}
+		handles = append(handles, tx)
+	}
+	if len(handles) == 0 {
+		t.Fatal("No undo handle could be acquired")
+	}
+
+	fmt.Println("Testing NewUndoTxTimeout when all handles are in use")
+	start := time.Now()
+	tx, err := transaction.NewUndoTxTimeout(10 * time.Millisecond)
+	assertEqual(t, err, transaction.ErrNoHandle)
+	if tx != nil || time.Since(start) < 10*time.Millisecond {
+		t.Error("NewUndoTxTimeout returned before the timeout")
+	}
+	assertEqual(t, transaction.Waiters("undo"), 0)
+
+	fmt.Println("Testing waiting goroutines are woken up on release")
+	got := make(chan transaction.TX)
+	go func() {
+		got <- transaction.NewUndoTx()
+	}()
+	go func() {
+		tx, _ := transaction.NewUndoTxTimeout(time.Minute)
+		got <- tx
+	}()
+	for transaction.Waiters("undo") != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	transaction.Release(handles[0])
+	transaction.Release(handles[1])
+	handles[0] = <-got
+	handles[1] = <-got
+	if handles[0] == nil || handles[1] == nil {
+		t.Error("Waiting goroutine did not get a handle")
+	}
+	assertEqual(t, transaction.Waiters("undo"), 0)
+	for _, tx := range handles {
+		transaction.Release(tx)
+	}
+}
+
+func TestRedoTxNoHandle(t *testing.T) {
+	transaction.SetMaxHandles("redo", 512)
+	defer transaction.SetMaxHandles("redo", 0)
+	fmt.Println("Testing TryNewRedoTx when all handles are in use")
+	var handles []transaction.TX
+	for {
+		tx, err := transaction.TryNewRedoTx()
+		if err != nil {
+			assertEqual(t, err, transaction.ErrNoHandle)
+			break
+		}
+		handles = append(handles, tx)
+	}
+	if len(handles) == 0 {
+		t.Fatal("No redo handle could be acquired")
+	}
+	tx, err := transaction.NewRedoTxTimeout(10 * time.Millisecond)
+	assertEqual(t, err, transaction.ErrNoHandle)
+	if tx != nil {
+		t.Error("NewRedoTxTimeout returned a handle when none was available")
+	}
+
+	got := make(chan transaction.TX)
+	go func() {
+		tx, _ := transaction.NewRedoTxTimeout(time.Minute)
+		got <- tx
+	}()
+	for transaction.Waiters("redo") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	transaction.Release(handles[0])
+	handles[0] = <-got
+	if handles[0] == nil {
+		t.Error("Waiting goroutine did not get a handle")
+	}
+	assertEqual(t, transaction.Waiters("redo"), 0)
+	for _, tx := range handles {
+		transaction.Release(tx)
+	}
+}
+
+func TestUndoTxGrow(t *testing.T) {
+	fmt.Println("Testing undo handles grow up to the maximum set")
+	transaction.SetMaxHandles("undo", 1024)
+	defer transaction.SetMaxHandles("undo", 0)
+	var handles []transaction.TX
+	for {
+		tx, err := transaction.TryNewUndoTx()
+		if err != nil {
+			break
+		}
+		handles = append(handles, tx)
+	}
+	if len(handles) <= 512 {
+		t.Fatalf("Only %d undo handles could be acquired", len(handles))
+	}
+
+	// Use a handle in the new segment
+	tx := handles[len(handles)-1]
+	a := pnew(int)
+	tx.Begin()
+	tx.Log3(unsafe.Pointer(a), intSize)
+	*a = 10
+	transaction.Release(tx) // Calls abort internally
+	assertEqual(t, *a, 0)
+	for _, tx := range handles[:len(handles)-1] {
+		transaction.Release(tx)
+	}
+
+	fmt.Println("Testing undo handles grow without a limit by default")
+	transaction.SetMaxHandles("undo", 0)
+	handles = handles[:0]
+	for i := 0; i < 1100; i++ {
+		tx, err := transaction.TryNewUndoTx()
+		if err != nil {
+			t.Fatalf("Only %d undo handles could be acquired", i)
+		}
+		handles = append(handles, tx)
+	}
+	for _, tx := range handles {
+		transaction.Release(tx)
+	}
+}
+
+func TestRedoTxGrow(t *testing.T) {
+	fmt.Println("Testing redo handles grow up to the maximum set")
+	transaction.SetMaxHandles("redo", 1024)
+	defer transaction.SetMaxHandles("redo", 0)
+	var handles []transaction.TX
+	for {
+		tx, err := transaction.TryNewRedoTx()
+		if err != nil {
+			break
+		}
+		handles = append(handles, tx)
+	}
+	if len(handles) <= 512 {
+		t.Fatalf("Only %d redo handles could be acquired", len(handles))
+	}
+
+	tx := handles[len(handles)-1]
+	a := pnew(int)
+	tx.Begin()
+	tx.Log(a, 10)
+	tx.End()
+	assertEqual(t, *a, 10)
+	for _, tx := range handles {
+		transaction.Release(tx)
+	}
+}
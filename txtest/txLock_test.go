@@ -10,6 +10,7 @@ import (
 	"sync"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/vmware/go-pmem-transaction/transaction"
 )
@@ -37,3 +38,219 @@ func TestRedoLogLock(t *testing.T) {
 	time.Sleep(5 * time.Second)
 	transaction.Release(tx)
 }
+
+// lockedFor returns true if m could not be write locked within 'wait'.
+func lockedFor(m *sync.RWMutex, wait time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		m.Lock()
+		m.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return false
+	case <-time.After(wait):
+		// The goroutine finishes once m is unlocked
+		return true
+	}
+}
+
+func TestTxLockReentrant(t *testing.T) {
+	fmt.Println("Testing repeated locking and lock upgrades")
+	m1 := new(sync.RWMutex)
+	m2 := new(sync.RWMutex)
+	for _, tx := range []transaction.TX{transaction.NewUndoTx(),
+		transaction.NewRedoTx()} {
+		tx.Begin()
+		assertEqual(t, tx.WLock(m1), nil)
+		assertEqual(t, tx.Lock(m1), nil)
+		assertEqual(t, tx.RLock(m1), nil)
+		assertEqual(t, tx.RLock(m2), nil)
+		assertEqual(t, tx.RLock(m2), nil)
+		assertEqual(t, tx.WLock(m2), nil) // upgrade read lock to write lock
+		assertEqual(t, lockedFor(m1, 10*time.Millisecond), true)
+		assertEqual(t, lockedFor(m2, 10*time.Millisecond), true)
+		tx.End()
+		assertEqual(t, lockedFor(m1, time.Second), false)
+		assertEqual(t, lockedFor(m2, time.Second), false)
+
+		fmt.Println("Testing LockAll")
+		tx.Begin()
+		assertEqual(t, tx.LockAll(m2, m1, m2), nil)
+		assertEqual(t, lockedFor(m1, 10*time.Millisecond), true)
+		assertEqual(t, lockedFor(m2, 10*time.Millisecond), true)
+		tx.End()
+		assertEqual(t, lockedFor(m1, time.Second), false)
+		assertEqual(t, lockedFor(m2, time.Second), false)
+		transaction.Release(tx)
+	}
+}
+
+func TestTxLockDeadlock(t *testing.T) {
+	fmt.Println("Testing deadlock detection aborts the victim transaction")
+	transaction.SetLockTimeout(50 * time.Millisecond)
+	defer transaction.SetLockTimeout(0)
+	m1 := new(sync.RWMutex)
+	m2 := new(sync.RWMutex)
+	a := pnew(int)
+	b := pnew(int)
+	tx1 := transaction.NewUndoTx()
+	tx2 := transaction.NewUndoTx()
+	tx1.Begin()
+	tx1.Lock(m1)
+	tx1.Log3(unsafe.Pointer(a), intSize)
+	*a = 1
+	tx2.Begin()
+	tx2.Lock(m2)
+	tx2.Log3(unsafe.Pointer(b), intSize)
+	*b = 1
+
+	errs := make(chan error, 2)
+	go func() {
+		err := tx1.Lock(m2)
+		if err == nil {
+			tx1.End()
+		}
+		errs <- err
+	}()
+	go func() {
+		err := tx2.Lock(m1)
+		if err == nil {
+			tx2.End()
+		}
+		errs <- err
+	}()
+	err1 := <-errs
+	err2 := <-errs
+	if err1 != transaction.ErrDeadlock && err2 != transaction.ErrDeadlock {
+		t.Fatal("Deadlock not detected")
+	}
+	// A victim's updates are reverted, while the other transaction commits
+	assertEqual(t, *a+*b <= 1, true)
+	assertEqual(t, lockedFor(m1, time.Second), false)
+	assertEqual(t, lockedFor(m2, time.Second), false)
+	transaction.Release(tx1)
+	transaction.Release(tx2)
+}
+
+func TestTxLockUpgrade(t *testing.T) {
+	fmt.Println("Testing lock upgrade fails if another writer got in between")
+	m := new(sync.RWMutex)
+	a := pnew(int)
+	tx1 := transaction.NewUndoTx()
+	tx2 := transaction.NewUndoTx()
+	tx1.Begin()
+	tx1.RLock(m)
+	done := make(chan error)
+	go func() {
+		tx2.Begin()
+		err := tx2.Lock(m)
+		if err == nil {
+			tx2.Log3(unsafe.Pointer(a), intSize)
+			*a = 2
+			tx2.End()
+		}
+		done <- err
+	}()
+	// Wait for tx2 to block on the write lock
+	time.Sleep(10 * time.Millisecond)
+	assertEqual(t, tx1.Lock(m), transaction.ErrDeadlock)
+	assertEqual(t, <-done, nil)
+	assertEqual(t, *a, 2)
+	assertEqual(t, lockedFor(m, time.Second), false)
+
+	fmt.Println("Testing uncontended lock upgrade succeeds")
+	tx1.Begin()
+	tx1.RLock(m)
+	assertEqual(t, tx1.Lock(m), nil)
+	tx1.Log3(unsafe.Pointer(a), intSize)
+	*a = 3
+	tx1.End()
+	assertEqual(t, *a, 3)
+	assertEqual(t, lockedFor(m, time.Second), false)
+	transaction.Release(tx1)
+	transaction.Release(tx2)
+}
+
+func TestRangeLocking(t *testing.T) {
+	fmt.Println("Testing range locking isolates transactions")
+	transaction.SetRangeLocking(true)
+	defer transaction.SetRangeLocking(false)
+	a := pnew([4]int)
+	for _, tx1 := range []transaction.TX{transaction.NewUndoTx(),
+		transaction.NewRedoTx()} {
+		tx2 := transaction.NewUndoTx()
+		tx1.Begin()
+		tx1.LogRange(a[:], 1, []int{1, 2})
+		read := make(chan int)
+		go func() {
+			tx2.Begin()
+			tx2.Read(unsafe.Pointer(&a[2]), intSize)
+			v := a[2]
+			tx2.End()
+			read <- v
+		}()
+		select {
+		case <-read:
+			t.Fatal("Data read while a transaction updating it is ongoing")
+		case <-time.After(20 * time.Millisecond):
+		}
+		tx1.End()
+		assertEqual(t, <-read, 2)
+
+		fmt.Println("Testing range locks are released on abort")
+		tx1.Begin()
+		tx1.Log3(unsafe.Pointer(&a[3]), intSize)
+		transaction.Release(tx1)
+		tx2.Begin()
+		assertEqual(t, tx2.Read(unsafe.Pointer(&a[0]), 4*intSize), nil)
+		tx2.End()
+		transaction.Release(tx2)
+		a[1], a[2] = 0, 0
+	}
+}
+
+func TestRangeLockUpgrade(t *testing.T) {
+	fmt.Println("Testing range lock upgrade is not failed by other stripes")
+	transaction.SetRangeLocking(true)
+	defer transaction.SetRangeLocking(false)
+	// a[0] and a[1024] are 8KB apart, and are covered by different locks
+	a := pnew([2048]int)
+	tx1 := transaction.NewUndoTx()
+	tx2 := transaction.NewUndoTx()
+	tx1.Begin()
+	assertEqual(t, tx1.Read(unsafe.Pointer(&a[0]), intSize), nil)
+	tx2.Begin()
+	assertEqual(t, tx2.Log3(unsafe.Pointer(&a[1024]), intSize), nil)
+	tx2.End()
+	assertEqual(t, tx1.Log3(unsafe.Pointer(&a[0]), intSize), nil)
+	tx1.End()
+	transaction.Release(tx1)
+	transaction.Release(tx2)
+
+	fmt.Println("Testing range locks taken in different orders do not hang")
+	tx1 = transaction.NewUndoTx()
+	tx2 = transaction.NewUndoTx()
+	tx1.Begin()
+	tx2.Begin()
+	tx1.Log3(unsafe.Pointer(&a[0]), intSize)
+	tx2.Log3(unsafe.Pointer(&a[1024]), intSize)
+	errs := make(chan error, 2)
+	go func() {
+		err := tx1.Log3(unsafe.Pointer(&a[1024]), intSize)
+		tx1.End()
+		errs <- err
+	}()
+	go func() {
+		err := tx2.Log3(unsafe.Pointer(&a[0]), intSize)
+		tx2.End()
+		errs <- err
+	}()
+	err1, err2 := <-errs, <-errs
+	if err1 != transaction.ErrDeadlock && err2 != transaction.ErrDeadlock {
+		t.Fatal("Deadlocked transactions were not aborted")
+	}
+	transaction.Release(tx1)
+	transaction.Release(tx2)
+}
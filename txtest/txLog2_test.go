@@ -0,0 +1,130 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+func TestUndoLog2(t *testing.T) {
+	resetData()
+	for i := range slice1 {
+		slice1[i] = i
+		slice2[i] = 100 + i
+	}
+	undoTx := transaction.NewUndoTx()
+
+	fmt.Println("Testing Log2 commit.")
+	undoTx.Begin()
+	undoTx.Log2(unsafe.Pointer(&slice2[0]), unsafe.Pointer(&slice1[0]), 10*intSize)
+	assertEqual(t, slice1[0], 100)
+	assertEqual(t, slice1[9], 109)
+	assertEqual(t, slice1[10], 10)
+	undoTx.End()
+	assertEqual(t, slice1[0], 100)
+	assertEqual(t, slice1[9], 109)
+	assertEqual(t, slice1[10], 10)
+
+	fmt.Println("Testing Log2 abort.")
+	undoTx.Begin()
+	undoTx.Log2(unsafe.Pointer(&slice2[50]), unsafe.Pointer(&slice1[20]), 30*intSize)
+	assertEqual(t, slice1[20], 150)
+	transaction.Release(undoTx) // Calls abort internally
+	for i := 20; i < 50; i++ {
+		assertEqual(t, slice1[i], i)
+	}
+
+	fmt.Println("Testing Log2 with unaligned, odd sized copy.")
+	bytes1 := pmake([]byte, 128)
+	bytes2 := pmake([]byte, 128)
+	for i := range bytes2 {
+		bytes2[i] = byte(i)
+	}
+	undoTx = transaction.NewUndoTx()
+	undoTx.Begin()
+	undoTx.Log2(unsafe.Pointer(&bytes2[3]), unsafe.Pointer(&bytes1[5]), 77)
+	undoTx.End()
+	assertEqual(t, bytes1[4], byte(0))
+	assertEqual(t, bytes1[5], byte(3))
+	assertEqual(t, bytes1[81], byte(79))
+	assertEqual(t, bytes1[82], byte(0))
+
+	fmt.Println("Testing Log2 with overlapping source and destination.")
+	for i := range slice1 {
+		slice1[i] = i
+	}
+	undoTx.Begin()
+	// Shift elements 0..89 to the right by 10 positions
+	undoTx.Log2(unsafe.Pointer(&slice1[0]), unsafe.Pointer(&slice1[10]), 90*intSize)
+	undoTx.End()
+	for i := 10; i < 100; i++ {
+		assertEqual(t, slice1[i], i-10)
+	}
+	undoTx.Begin()
+	// Shift elements back to the left and abort
+	undoTx.Log2(unsafe.Pointer(&slice1[10]), unsafe.Pointer(&slice1[0]), 90*intSize)
+	assertEqual(t, slice1[0], 0)
+	assertEqual(t, slice1[1], 1)
+	transaction.Release(undoTx)
+	for i := 10; i < 100; i++ {
+		assertEqual(t, slice1[i], i-10)
+	}
+}
+
+func TestRedoLog2(t *testing.T) {
+	resetData()
+	for i := range slice1 {
+		slice1[i] = i
+		slice2[i] = 100 + i
+	}
+	redoTx := transaction.NewRedoTx()
+
+	fmt.Println("Testing redo Log2 commit.")
+	redoTx.Begin()
+	redoTx.Log2(unsafe.Pointer(&slice2[0]), unsafe.Pointer(&slice1[0]), 10*intSize)
+	assertEqual(t, slice1[0], 0)
+	assertEqual(t, redoTx.ReadLog(&slice1[9]), 109)
+	redoTx.End()
+	assertEqual(t, slice1[0], 100)
+	assertEqual(t, slice1[9], 109)
+	assertEqual(t, slice1[10], 10)
+
+	fmt.Println("Testing redo Log2 abort.")
+	redoTx.Begin()
+	redoTx.Log2(unsafe.Pointer(&slice2[50]), unsafe.Pointer(&slice1[20]), 30*intSize)
+	transaction.Release(redoTx) // Calls abort internally
+	for i := 20; i < 50; i++ {
+		assertEqual(t, slice1[i], i)
+	}
+
+	fmt.Println("Testing redo Log2 reads data staged for the source.")
+	redoTx = transaction.NewRedoTx()
+	redoTx.Begin()
+	redoTx.Log3(unsafe.Pointer(&slice2[0]), 2*intSize)
+	buf := (*[2]int)(redoTx.ReadLog(unsafe.Pointer(&slice2[0])).(unsafe.Pointer))
+	buf[1] = 7
+	redoTx.Log2(unsafe.Pointer(&slice2[0]), unsafe.Pointer(&slice1[60]), 2*intSize)
+	redoTx.End()
+	assertEqual(t, slice1[60], 100)
+	assertEqual(t, slice1[61], 7)
+
+	fmt.Println("Testing redo Log2 with overlapping source and destination.")
+	for i := range slice1 {
+		slice1[i] = i
+	}
+	redoTx.Begin()
+	// Shift elements 0..89 to the right by 10 positions
+	redoTx.Log2(unsafe.Pointer(&slice1[0]), unsafe.Pointer(&slice1[10]), 90*intSize)
+	redoTx.End()
+	for i := 10; i < 100; i++ {
+		assertEqual(t, slice1[i], i-10)
+	}
+	transaction.Release(redoTx)
+}
@@ -7,6 +7,7 @@ package txtest
 
 import (
 	"fmt"
+	"runtime"
 	"testing"
 	"unsafe"
 
@@ -192,3 +193,100 @@ func TestUndoLog3Expand(t *testing.T) {
 		assertEqual(t, slice1[i], 0)
 	}
 }
+
+func TestUndoOldValue(t *testing.T) {
+	resetData()
+	*j = 10
+	struct1.i = 1
+	struct1.slice = slice1
+	undoTx := transaction.NewUndoTx()
+
+	fmt.Println("Testing undo OldValue for data updated in the transaction.")
+	undoTx.Begin()
+	undoTx.Log3(unsafe.Pointer(j), 8)
+	*j = 20
+	assertEqual(t, transaction.OldValue(undoTx, j).(int), 10)
+	undoTx.Log3(unsafe.Pointer(j), 8) // Logging again should not change it
+	*j = 30
+	assertEqual(t, transaction.OldValue(undoTx, j).(int), 10)
+	assertEqual(t, *j, 30)
+
+	fmt.Println("Testing undo OldValue for partially logged struct.")
+	undoTx.Log3(unsafe.Pointer(&struct1.i), 8)
+	struct1.i = 100
+	oldStruct := transaction.OldValue(undoTx, struct1).(structLogTest)
+	assertEqual(t, oldStruct.i, 1)
+	assertEqual(t, len(oldStruct.slice), 100)
+	undoTx.Log3(unsafe.Pointer(struct1), unsafe.Sizeof(*struct1))
+	struct1.slice = nil
+	oldStruct = transaction.OldValue(undoTx, struct1).(structLogTest)
+	assertEqual(t, oldStruct.i, 1)
+	assertEqual(t, len(oldStruct.slice), 100)
+	undoTx.End()
+
+	fmt.Println("Testing undo OldValue after the transaction ended.")
+	undoTx.Begin()
+	assertEqual(t, transaction.OldValue(undoTx, j).(int), 30)
+	assertEqual(t, transaction.OldValue(undoTx, &struct1.i).(int), 100)
+	undoTx.End()
+
+	fmt.Println("Testing undo OldValue for struct with pointer fields.")
+	iptr := pnew(int)
+	*iptr = 5
+	struct1.iptr = iptr
+	undoTx.Begin()
+	undoTx.Log3(unsafe.Pointer(&struct1.iptr), intSize)
+	struct1.iptr = pnew(int)
+	iptr = nil
+	runtime.GC() // The old pointer is only found in the log
+	oldStruct = transaction.OldValue(undoTx, struct1).(structLogTest)
+	runtime.GC()
+	assertEqual(t, *oldStruct.iptr, 5)
+	assertEqual(t, *struct1.iptr, 0)
+	undoTx.End()
+	transaction.Release(undoTx)
+
+	fmt.Println("Testing redo OldValue.")
+	redoTx := transaction.NewRedoTx()
+	redoTx.Begin()
+	redoTx.Log(j, 40)
+	assertEqual(t, transaction.OldValue(redoTx, j).(int), 30)
+	redoTx.End()
+	transaction.Release(redoTx)
+}
+
+func TestUndoLog3Volatile(t *testing.T) {
+	resetData()
+	x := new(int) // in volatile memory
+	vs := make([]int, 10)
+	vstruct := new(structLogTest)
+	vstruct.iptr = j
+	undoTx := transaction.NewUndoTx()
+
+	fmt.Println("Testing commit of volatile data logged with Log3")
+	undoTx.Begin()
+	assertEqual(t, undoTx.Log3(unsafe.Pointer(x), intSize), nil)
+	*x = 10
+	undoTx.End()
+	assertEqual(t, *x, 10)
+
+	fmt.Println("Testing abort of volatile data logged with Log3")
+	undoTx.Begin()
+	undoTx.Log3(unsafe.Pointer(x), intSize)
+	undoTx.Log3(unsafe.Pointer(&vs[0]), 10*intSize)
+	undoTx.Log3(unsafe.Pointer(vstruct), unsafe.Sizeof(*vstruct))
+	undoTx.Log3(unsafe.Pointer(j), intSize)
+	*x = 20
+	vs[5] = 5
+	vstruct.iptr = nil
+	*j = 30
+	assertEqual(t, transaction.OldValue(undoTx, x).(int), 10)
+	assertEqual(t, transaction.OldValue(undoTx, &vs[5]).(int), 0)
+	undoTx.Log3(unsafe.Pointer(x), intSize)
+	*x = 40
+	transaction.Release(undoTx)
+	assertEqual(t, *x, 10)
+	assertEqual(t, vs[5], 0)
+	assertEqual(t, vstruct.iptr, j)
+	assertEqual(t, *j, 0)
+}
@@ -0,0 +1,72 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+func TestOptimisticTx(t *testing.T) {
+	a := pnew(int)
+	b := pnew(int)
+
+	fmt.Println("Testing optimistic transaction commit")
+	tx := transaction.NewOptimisticTx()
+	tx.Begin()
+	assertEqual(t, tx.ReadLog(a), 0)
+	tx.Log(a, 10)
+	assertEqual(t, tx.ReadLog(a), 10)
+	assertEqual(t, *a, 0)
+	assertEqual(t, tx.End(), true)
+	assertEqual(t, *a, 10)
+
+	fmt.Println("Testing optimistic transaction conflict")
+	tx.Begin()
+	assertEqual(t, tx.Read(unsafe.Pointer(a), intSize), nil)
+	tx.Log(b, *a+1)
+	err := transaction.RunOptimistic(1, func(tx transaction.TX) error {
+		return tx.Log(a, 20)
+	})
+	assertEqual(t, err, nil)
+	assertEqual(t, *a, 20)
+	assertEqual(t, tx.End(), false)
+	assertEqual(t, *b, 0)
+
+	tx.Begin()
+	assertEqual(t, tx.Read(unsafe.Pointer(a), intSize), nil)
+	tx.Log(b, *a+1)
+	assertEqual(t, tx.End(), true)
+	assertEqual(t, *b, 21)
+	transaction.Release(tx)
+
+	fmt.Println("Testing concurrent optimistic transactions")
+	*a = 0
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				err := transaction.RunOptimistic(1000,
+					func(tx transaction.TX) error {
+						v := tx.ReadLog(a).(int)
+						return tx.Log(a, v+1)
+					})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, *a, 800)
+}
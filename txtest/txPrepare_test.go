@@ -0,0 +1,83 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+func TestPrepare(t *testing.T) {
+	a := pnew(int)
+	s := pmake([]int, 2)
+	m := new(sync.RWMutex)
+
+	fmt.Println("Testing prepare and commit of redo transaction")
+	tx := transaction.NewRedoTx()
+	tx.Begin()
+	tx.WLock(m)
+	tx.Log(a, 10)
+	tx.Log(&s, []int{1, 2, 3})
+	assertEqual(t, transaction.Prepare(tx, "xid-1"), nil)
+	assertEqual(t, *a, 0)
+	assertEqual(t, len(s), 2)
+	ids := transaction.PreparedTxs()
+	assertEqual(t, len(ids), 1)
+	assertEqual(t, ids[0], "xid-1")
+	// Locks are held till the outcome is decided
+	assertEqual(t, lockedFor(m, 10*time.Millisecond), true)
+	assertEqual(t, transaction.CommitPrepared("xid-1"), nil)
+	assertEqual(t, lockedFor(m, time.Second), false)
+	assertEqual(t, *a, 10)
+	assertEqual(t, len(s), 3)
+	assertEqual(t, len(transaction.PreparedTxs()), 0)
+	assertEqual(t, transaction.CommitPrepared("xid-1") != nil, true)
+
+	fmt.Println("Testing prepare and abort of redo transaction")
+	tx = transaction.NewRedoTx()
+	tx.Begin()
+	tx.Log(a, 20)
+	assertEqual(t, transaction.Prepare(tx, "xid-2"), nil)
+	assertEqual(t, transaction.AbortPrepared("xid-2"), nil)
+	assertEqual(t, *a, 10)
+	assertEqual(t, transaction.AbortPrepared("xid-2") != nil, true)
+
+	fmt.Println("Testing invalid prepare calls")
+	utx := transaction.NewUndoTx()
+	utx.Begin()
+	assertEqual(t, transaction.Prepare(utx, "xid-3") != nil, true)
+	utx.End()
+	transaction.Release(utx)
+	tx = transaction.NewRedoTx()
+	assertEqual(t, transaction.Prepare(tx, "xid-3") != nil, true)
+	tx.Begin()
+	tx.Begin()
+	assertEqual(t, transaction.Prepare(tx, "xid-3") != nil, true)
+	tx.End()
+	assertEqual(t, transaction.Prepare(tx, "") != nil, true)
+	tx.End()
+	transaction.Release(tx)
+	tx = transaction.NewRedoTx()
+	tx.Begin("deferred")
+	assertEqual(t, transaction.Prepare(tx, "xid-3") != nil, true)
+	tx.End()
+	transaction.Release(tx)
+
+	fmt.Println("Testing duplicate prepared transaction ID")
+	tx = transaction.NewRedoTx()
+	tx.Begin()
+	assertEqual(t, transaction.Prepare(tx, "xid-4"), nil)
+	tx2 := transaction.NewRedoTx()
+	tx2.Begin()
+	assertEqual(t, transaction.Prepare(tx2, "xid-4") != nil, true)
+	tx2.End()
+	transaction.Release(tx2)
+	assertEqual(t, transaction.AbortPrepared("xid-4"), nil)
+}
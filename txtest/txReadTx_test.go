@@ -0,0 +1,62 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+func TestReadTx(t *testing.T) {
+	a := pnew(int)
+	*a = 10
+	s := pmake([]int, 5)
+	s[2] = 20
+	m := new(sync.RWMutex)
+
+	fmt.Println("Testing read-only transaction reads")
+	tx := transaction.NewReadTx()
+	tx.Begin()
+	assertEqual(t, tx.RLock(m), nil)
+	assertEqual(t, tx.ReadLog(a), 10)
+	assertEqual(t, tx.ReadLog(&s, 2), 20)
+	assertEqual(t, len(tx.ReadLog(&s, 1, 3).([]int)), 2)
+	assertEqual(t, transaction.OldValue(tx, a), 10)
+
+	fmt.Println("Testing updates in read-only transaction")
+	assertEqual(t, tx.Log(a, 20), transaction.ErrReadOnly)
+	assertEqual(t, tx.Log3(unsafe.Pointer(a), intSize), transaction.ErrReadOnly)
+	assertEqual(t, tx.Log2(unsafe.Pointer(a), unsafe.Pointer(&s[0]), intSize),
+		transaction.ErrReadOnly)
+	assertEqual(t, tx.LogRange(s, 0, []int{1}), transaction.ErrReadOnly)
+	assertEqual(t, tx.WLock(m), transaction.ErrReadOnly)
+	assertEqual(t, tx.LockAll(m), transaction.ErrReadOnly)
+	assertEqual(t, *a, 10)
+
+	fmt.Println("Testing read locks released at End")
+	assertEqual(t, lockedFor(m, 10*time.Millisecond), true)
+	tx.End()
+	assertEqual(t, lockedFor(m, time.Second), false)
+	transaction.Release(tx)
+
+	fmt.Println("Testing read-only transactions do not use log handles")
+	// More handles than the default maximum of undo or redo handles
+	var txs []transaction.TX
+	for i := 0; i < 1024; i++ {
+		txs = append(txs, transaction.NewReadTx())
+	}
+	utx, err := transaction.TryNewUndoTx()
+	assertEqual(t, err, nil)
+	transaction.Release(utx)
+	for _, rtx := range txs {
+		transaction.Release(rtx)
+	}
+}
@@ -8,6 +8,7 @@ package txtest
 import (
 	"errors"
 	"fmt"
+	"runtime"
 	"sync"
 	"testing"
 	"unsafe"
@@ -18,6 +19,7 @@ import (
 func BenchmarkRedoLogInt(b *testing.B) {
 	j = pnew(int)
 	tx := transaction.NewRedoTx()
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		tx.Begin()
@@ -29,8 +31,27 @@ func BenchmarkRedoLogInt(b *testing.B) {
 
 func BenchmarkRedoLog100Ints(b *testing.B) {
 	slice1 = pmake([]int, 100)
-	tx := transaction.NewUndoTx()
+	tx := transaction.NewRedoTx()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx.Begin()
+		for c := 0; c < 100; c++ {
+			tx.Log(&slice1[c], i)
+		}
+		tx.End()
+	}
+	transaction.Release(tx)
+}
+
+// Logs 100 adjacent ints per transaction and reports the number of cachelines
+// flushed by each transaction as it ends.
+func BenchmarkRedoCommitFlushes(b *testing.B) {
+	slice1 = pmake([]int, 100)
+	tx := transaction.NewRedoTx()
+	b.ReportAllocs()
 	b.ResetTimer()
+	start := transaction.FlushCount()
 	for i := 0; i < b.N; i++ {
 		tx.Begin()
 		for c := 0; c < 100; c++ {
@@ -38,6 +59,10 @@ func BenchmarkRedoLog100Ints(b *testing.B) {
 		}
 		tx.End()
 	}
+	b.StopTimer()
+	flushes := transaction.FlushCount() - start
+	b.Logf("%d transactions, %.1f cachelines flushed per transaction", b.N,
+		float64(flushes)/float64(b.N))
 	transaction.Release(tx)
 }
 
@@ -47,6 +72,7 @@ func BenchmarkRedoLogSlice(b *testing.B) {
 	struct1.slice = pmake([]int, 10000)
 	struct2.slice = pmake([]int, 10000)
 	tx := transaction.NewRedoTx()
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		tx.Begin()
@@ -62,6 +88,7 @@ func BenchmarkRedoLogReadInt(b *testing.B) {
 	tx := transaction.NewRedoTx()
 	tx.Begin()
 	tx.Log(j, b.N)
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		a := tx.ReadLog(j)
@@ -111,6 +138,46 @@ func TestRedoLogRead(t *testing.T) {
 	assertEqual(t, len(struct1.slice), 4)
 	assertEqual(t, struct1.slice[2], 90)
 	assertEqual(t, *j, 91)
+
+	fmt.Println("Testing TX.Readlog of arrays with parts logged")
+	arr := pnew([64]byte)
+	ptrs := pnew([4]*int)
+	tx = transaction.NewRedoTx()
+	tx.Begin()
+	tx.Log3(unsafe.Pointer(&arr[8]), 4)
+	(*[4]byte)(tx.ReadLog(unsafe.Pointer(&arr[8])).(unsafe.Pointer))[1] = 9
+	tx.Log(&arr[10], byte(10))
+	tx.Log(ptrs, [4]*int{nil, j})
+	gotArr := tx.ReadLog(arr).([64]byte)
+	assertEqual(t, gotArr[9], byte(9))
+	assertEqual(t, gotArr[10], byte(10))
+	assertEqual(t, gotArr[11], byte(0))
+	assertEqual(t, tx.ReadLog(ptrs).([4]*int)[1], j)
+	tx.Log(&ptrs[2], j)
+	gotPtrs := tx.ReadLog(ptrs).([4]*int)
+	assertEqual(t, gotPtrs[1], j)
+	assertEqual(t, gotPtrs[2], j)
+	tx.End()
+	transaction.Release(tx)
+	assertEqual(t, arr[9], byte(9))
+	assertEqual(t, ptrs[2], j)
+}
+
+func BenchmarkRedoReadLogArray(b *testing.B) {
+	arr := pnew([4096]byte)
+	tx := transaction.NewRedoTx()
+	tx.Begin()
+	for i := 0; i < 100; i++ {
+		tx.Log3(unsafe.Pointer(&arr[i*40]), 8)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = tx.ReadLog(arr)
+	}
+	b.StopTimer()
+	tx.End()
+	transaction.Release(tx)
 }
 
 func TestRedoLogExpand(t *testing.T) {
@@ -495,6 +562,285 @@ func TestRedoLogBasic(t *testing.T) {
 	transaction.Release(redoTx)
 }
 
+func TestRedoLog3(t *testing.T) {
+	resetData()
+	redoTx := transaction.NewRedoTx()
+
+	fmt.Println("Testing redo Log3 commit.")
+	struct1.i = 1
+	redoTx.Begin()
+	redoTx.Log3(unsafe.Pointer(struct1), unsafe.Sizeof(*struct1))
+	buf := (*structLogTest)(redoTx.ReadLog(unsafe.Pointer(struct1)).(unsafe.Pointer))
+	assertEqual(t, buf.i, 1)
+	buf.i = 10
+	buf.slice = slice1
+	assertEqual(t, struct1.i, 1)
+	assertEqual(t, redoTx.ReadLog(&struct1.i).(int), 10)
+	assertEqual(t, len(redoTx.ReadLog(&struct1.slice).([]int)), 100)
+	redoTx.End()
+	assertEqual(t, struct1.i, 10)
+	assertEqual(t, len(struct1.slice), 100)
+
+	fmt.Println("Testing redo Log3 abort.")
+	redoTx.Begin()
+	redoTx.Log3(unsafe.Pointer(&slice1[0]), 10*intSize)
+	bufSlc := (*[10]int)(redoTx.ReadLog(unsafe.Pointer(&slice1[0])).(unsafe.Pointer))
+	bufSlc[5] = 5
+	assertEqual(t, redoTx.ReadLog(&slice1[5]).(int), 5)
+	assertEqual(t, redoTx.ReadLog(&slice1, 5).(int), 5)
+	transaction.Release(redoTx)
+	assertEqual(t, slice1[5], 0)
+
+	fmt.Println("Testing redo Log3 of a range logged before.")
+	redoTx = transaction.NewRedoTx()
+	redoTx.Begin()
+	redoTx.Log3(unsafe.Pointer(&slice1[0]), 2*intSize)
+	bufSlc = (*[10]int)(redoTx.ReadLog(unsafe.Pointer(&slice1[0])).(unsafe.Pointer))
+	bufSlc[1] = 1
+	redoTx.Log3(unsafe.Pointer(&slice1[0]), 10*intSize)
+	bufSlc = (*[10]int)(redoTx.ReadLog(unsafe.Pointer(&slice1[0])).(unsafe.Pointer))
+	assertEqual(t, bufSlc[1], 1)
+	bufSlc[9] = 9
+	redoTx.End()
+	transaction.Release(redoTx)
+	assertEqual(t, slice1[1], 1)
+	assertEqual(t, slice1[9], 9)
+
+	fmt.Println("Testing redo Log3 of a range partly logged before.")
+	redoTx = transaction.NewRedoTx()
+	redoTx.Begin()
+	redoTx.Log3(unsafe.Pointer(&slice1[2]), 2*intSize)
+	bufSlc = (*[10]int)(redoTx.ReadLog(unsafe.Pointer(&slice1[2])).(unsafe.Pointer))
+	bufSlc[1] = 30
+	redoTx.Log3(unsafe.Pointer(&slice1[3]), 2*intSize)
+	assertEqual(t, redoTx.ReadLog(&slice1[3]).(int), 30)
+	bufSlc = (*[10]int)(redoTx.ReadLog(unsafe.Pointer(&slice1[3])).(unsafe.Pointer))
+	bufSlc[1] = 40
+	redoTx.End()
+	transaction.Release(redoTx)
+	assertEqual(t, slice1[3], 30)
+	assertEqual(t, slice1[4], 40)
+
+	fmt.Println("Testing undo and redo Log3 with the same calls.")
+	for _, tx := range []transaction.TX{transaction.NewUndoTx(),
+		transaction.NewRedoTx()} {
+		*j = 0
+		tx.Begin()
+		tx.Log3(unsafe.Pointer(j), intSize)
+		*(*int)(tx.ReadLog(unsafe.Pointer(j)).(unsafe.Pointer)) = 20
+		tx.End()
+		transaction.Release(tx)
+		assertEqual(t, *j, 20)
+	}
+
+	fmt.Println("Testing pointers stored in the redo Log3 buffer.")
+	redoTx = transaction.NewRedoTx()
+	struct1.slice = nil
+	redoTx.Begin()
+	redoTx.Log3(unsafe.Pointer(struct1), unsafe.Sizeof(*struct1))
+	buf = (*structLogTest)(redoTx.ReadLog(unsafe.Pointer(struct1)).(unsafe.Pointer))
+	buf.slice = pmake([]int, 5)
+	buf.slice[4] = 4
+	runtime.GC()
+	redoTx.End()
+	transaction.Release(redoTx)
+	assertEqual(t, struct1.slice[4], 4)
+
+	fmt.Println("Testing undo and redo Log3 of volatile data.")
+	for _, tx := range []transaction.TX{transaction.NewUndoTx(),
+		transaction.NewRedoTx()} {
+		v := new(int)
+		tx.Begin()
+		assertEqual(t, tx.Log3(unsafe.Pointer(v), intSize), nil)
+		*(*int)(tx.ReadLog(unsafe.Pointer(v)).(unsafe.Pointer)) = 5
+		tx.End()
+		transaction.Release(tx)
+		assertEqual(t, *v, 5)
+	}
+}
+
+func TestRedoLogUnexported(t *testing.T) {
+	type inner struct {
+		i    int
+		s    string
+		intf interface{}
+	}
+	type outer struct {
+		b     bool
+		in    inner
+		slice []int
+		iptr  *int
+		m     map[int]int
+	}
+	fmt.Println("Testing logging struct with unexported composite fields")
+	st1 := pnew(outer)
+	st2 := pnew(outer)
+	st1.slice = pmake([]int, 10)
+	st2.b = true
+	st2.in.i = 10
+	st2.in.s = "Hello"
+	st2.in.intf = 20
+	st2.slice = pmake([]int, 20)
+	st2.slice[15] = 15
+	st2.iptr = &st2.in.i
+	st2.m = map[int]int{1: 1}
+	redoTx := transaction.NewRedoTx()
+	redoTx.Begin()
+	redoTx.Log(st1, *st2)
+	assertEqual(t, st1.b, false)
+	assertEqual(t, st1.in.i, 0)
+	assertEqual(t, len(st1.slice), 10)
+	tmp := redoTx.ReadLog(st1).(outer)
+	assertEqual(t, tmp.b, true)
+	assertEqual(t, tmp.in, st2.in)
+	assertEqual(t, len(tmp.slice), 20)
+	assertEqual(t, tmp.iptr, st2.iptr)
+	assertEqual(t, tmp.m[1], 1)
+	tmpIn := redoTx.ReadLog(&st1.in).(inner)
+	assertEqual(t, tmpIn.intf.(int), 20)
+	redoTx.Log(&st1.in, inner{i: 30})
+	assertEqual(t, redoTx.ReadLog(&st1.in.i).(int), 30)
+	redoTx.End()
+	assertEqual(t, st1.b, true)
+	assertEqual(t, st1.in.i, 30)
+	assertEqual(t, st1.in.s, "")
+	assertEqual(t, st1.in.intf, nil)
+	assertEqual(t, len(st1.slice), 20)
+	assertEqual(t, st1.slice[15], 15)
+	assertEqual(t, st1.iptr, &st2.in.i)
+	assertEqual(t, st1.m[1], 1)
+
+	fmt.Println("Testing abort of struct with unexported composite fields")
+	redoTx.Begin()
+	redoTx.Log(st1, outer{in: inner{i: 40}, slice: pmake([]int, 5)})
+	assertEqual(t, len(redoTx.ReadLog(st1).(outer).slice), 5)
+	transaction.Release(redoTx)
+	assertEqual(t, st1.in.i, 30)
+	assertEqual(t, len(st1.slice), 20)
+}
+
+func TestRedoLogSliceResize(t *testing.T) {
+	resetData()
+	struct1.slice = pmake([]int, 10)
+	redoTx := transaction.NewRedoTx()
+
+	fmt.Println("Testing error for logging slices of different length")
+	redoTx.Begin()
+	err := redoTx.Log(slice1, slice2[:50])
+	if err == nil {
+		assertEqual(t, 0, 1) // Assert
+	}
+	redoTx.End()
+
+	fmt.Println("Testing slice grow commit with new backing array")
+	redoTx.Begin()
+	newSlice := make([]int, 20)
+	newSlice[15] = 15
+	redoTx.Log(&struct1.slice, newSlice)
+	assertEqual(t, redoTx.ReadLog(&struct1.slice, 15).(int), 15)
+	assertEqual(t, len(redoTx.ReadLog(&struct1.slice, 5, 20).([]int)), 15)
+	redoTx.LogRange(&struct1.slice, 10, []int{1, 2, 3})
+	assertEqual(t, redoTx.ReadLog(&struct1.slice, 11).(int), 2)
+	assertEqual(t, redoTx.ReadLog(&struct1.slice, 10, 13).([]int)[2], 3)
+	assertEqual(t, len(struct1.slice), 10)
+	redoTx.End()
+	assertEqual(t, len(struct1.slice), 20)
+	assertEqual(t, struct1.slice[11], 2)
+	assertEqual(t, struct1.slice[15], 15)
+
+	fmt.Println("Testing slice shrink abort")
+	redoTx.Begin()
+	redoTx.Log(&struct1.slice, struct1.slice[:5])
+	assertEqual(t, len(redoTx.ReadLog(&struct1.slice).([]int)), 5)
+	assertEqual(t, len(redoTx.ReadLog(&struct1.slice, 0, 5).([]int)), 5)
+	transaction.Release(redoTx)
+	assertEqual(t, len(struct1.slice), 20)
+
+	fmt.Println("Testing LogRange with elements logged before and after")
+	redoTx = transaction.NewRedoTx()
+	redoTx.Begin()
+	redoTx.Log(&slice1[1], 10)
+	redoTx.Log(&slice1[2], 20)
+	redoTx.LogRange(slice1, 0, []int{1, 2, 3, 4})
+	assertEqual(t, redoTx.ReadLog(&slice1[1]).(int), 2)
+	redoTx.Log(&slice1[2], 30)
+	assertEqual(t, redoTx.ReadLog(&slice1[2]).(int), 30)
+	assertEqual(t, redoTx.ReadLog(&slice1, 3).(int), 4)
+	assertEqual(t, slice1[3], 0)
+	redoTx.End()
+	transaction.Release(redoTx)
+	assertEqual(t, slice1[0], 1)
+	assertEqual(t, slice1[1], 2)
+	assertEqual(t, slice1[2], 30)
+	assertEqual(t, slice1[3], 4)
+
+	fmt.Println("Testing undo LogRange")
+	undoTx := transaction.NewUndoTx()
+	undoTx.Begin()
+	undoTx.LogRange(slice1, 50, []int{5, 6})
+	assertEqual(t, slice1[51], 6)
+	undoTx.End()
+	undoTx.Begin()
+	undoTx.LogRange(&slice1, 50, []int{7, 8})
+	assertEqual(t, slice1[51], 8)
+	transaction.Release(undoTx)
+	assertEqual(t, slice1[50], 5)
+	assertEqual(t, slice1[51], 6)
+}
+
+func TestRedoLogReadComposite(t *testing.T) {
+	type elem struct {
+		i int
+		s string
+	}
+	type composite struct {
+		arr   [4]elem
+		elems []elem
+		m     map[string]*elem
+	}
+	c := pnew(composite)
+	c.elems = pmake([]elem, 4)
+	c.m = make(map[string]*elem)
+	c.m["a"] = &c.elems[0]
+	redoTx := transaction.NewRedoTx()
+
+	fmt.Println("Testing ReadLog of struct logged inside an array element")
+	redoTx.Begin()
+	redoTx.Log(&c.arr[2], elem{i: 2, s: "two"})
+	redoTx.Log(&c.arr[3].i, 3)
+	tmp := redoTx.ReadLog(c).(composite)
+	assertEqual(t, tmp.arr[2], elem{i: 2, s: "two"})
+	assertEqual(t, tmp.arr[3].i, 3)
+	tmpArr := redoTx.ReadLog(&c.arr).([4]elem)
+	assertEqual(t, tmpArr[2].s, "two")
+
+	fmt.Println("Testing ReadLog of array logged after its elements")
+	redoTx.Log(&c.arr, [4]elem{{i: 10}, {i: 11}, {i: 12}, {i: 13}})
+	tmpArr = redoTx.ReadLog(&c.arr).([4]elem)
+	assertEqual(t, tmpArr[2], elem{i: 12})
+	redoTx.Log(&c.arr[1].s, "one")
+	tmpArr = redoTx.ReadLog(&c.arr).([4]elem)
+	assertEqual(t, tmpArr[1], elem{i: 11, s: "one"})
+	assertEqual(t, tmpArr[3], elem{i: 13})
+
+	fmt.Println("Testing ReadLog of struct elements of a slice")
+	redoTx.Log(&c.elems[1], elem{i: 1, s: "one"})
+	assertEqual(t, redoTx.ReadLog(&c.elems, 1).(elem), elem{i: 1, s: "one"})
+	assertEqual(t, redoTx.ReadLog(&c.elems, 0, 2).([]elem)[1].s, "one")
+
+	fmt.Println("Testing ReadLog of map of pointers")
+	redoTx.Log(c.m["a"], elem{i: 100})
+	assertEqual(t, redoTx.ReadLog(c.m, "a").(elem).i, 100)
+	assertEqual(t, redoTx.ReadLog(&c.m, "a").(elem).i, 100)
+	assertEqual(t, c.elems[0].i, 0)
+	redoTx.End()
+	transaction.Release(redoTx)
+	assertEqual(t, c.arr[1], elem{i: 11, s: "one"})
+	assertEqual(t, c.arr[2], elem{i: 12})
+	assertEqual(t, c.elems[1].s, "one")
+	assertEqual(t, c.elems[0].i, 100)
+}
+
 func TestRedoLogIsolation(t *testing.T) {
 	resetData()
 	var wg sync.WaitGroup
@@ -0,0 +1,108 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+// countingTx is a transaction kind registered by the tests. It uses undo
+// transactions underneath, and keeps the number of handles in use in its log.
+type (
+	countingTx struct {
+		transaction.TX
+	}
+	countingLog struct {
+		magic int
+		inUse int
+	}
+)
+
+const countingMagic = 271828
+
+var (
+	countingHead      *countingLog
+	countingInits     int
+	countingRecovered int
+
+	// Package variables are initialized before init(), so the kind is
+	// registered before pmem.Init() is called.
+	_ = registerCountingTx()
+)
+
+func registerCountingTx() bool {
+	transaction.Register("countingTx", transaction.Factory{
+		Init: func() unsafe.Pointer {
+			countingInits++
+			countingHead = pnew(countingLog)
+			countingHead.magic = countingMagic
+			return unsafe.Pointer(countingHead)
+		},
+		Recover: func(logHeadPtr unsafe.Pointer, swizzle bool) {
+			if !swizzle {
+				countingRecovered++
+				countingHead = (*countingLog)(logHeadPtr)
+				countingHead.inUse = 0
+			}
+		},
+		Acquire: func() transaction.TX {
+			countingHead.inUse++
+			return &countingTx{transaction.NewUndoTx()}
+		},
+		Release: func(tx transaction.TX) {
+			countingHead.inUse--
+			transaction.Release(tx.(*countingTx).TX)
+		},
+	})
+	return true
+}
+
+func TestRegistry(t *testing.T) {
+	fmt.Println("Testing registered transaction kinds")
+	assertEqual(t, transaction.Registered("undo"), true)
+	assertEqual(t, transaction.Registered("redo"), true)
+	assertEqual(t, transaction.Registered("shadow"), true)
+	assertEqual(t, transaction.Registered("optimistic"), true)
+	assertEqual(t, transaction.Registered("countingTx"), true)
+	assertEqual(t, transaction.Registered("noSuchTx"), false)
+	kinds := transaction.Kinds()
+	assertEqual(t, kinds[0], "undo")
+	assertEqual(t, kinds[len(kinds)-1], "countingTx")
+
+	fmt.Println("Testing log of a registered kind initialized by pmem.Init")
+	assertEqual(t, countingInits, 1)
+	assertEqual(t, countingHead.magic, countingMagic)
+
+	fmt.Println("Testing kind which keeps no log of its own")
+	assertEqual(t, transaction.Init(nil, "shadow"), unsafe.Pointer(nil))
+	stx := transaction.New("shadow")
+	transaction.Release(stx)
+
+	fmt.Println("Testing acquiring and releasing handles of a registered kind")
+	a := pnew(int)
+	tx := transaction.New("countingTx")
+	_, ok := tx.(*countingTx)
+	assertEqual(t, ok, true)
+	assertEqual(t, countingHead.inUse, 1)
+	tx.Begin()
+	tx.Log3(unsafe.Pointer(a), intSize)
+	*a = 10
+	tx.End()
+	assertEqual(t, *a, 10)
+	transaction.Release(tx)
+	assertEqual(t, countingHead.inUse, 0)
+
+	fmt.Println("Testing recovery of a registered kind")
+	countingHead.inUse = 5
+	head := transaction.Init(unsafe.Pointer(countingHead), "countingTx")
+	assertEqual(t, head, unsafe.Pointer(countingHead))
+	assertEqual(t, countingRecovered, 1)
+	assertEqual(t, countingHead.inUse, 0)
+}
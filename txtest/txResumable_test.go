@@ -0,0 +1,141 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+func TestResumableRedo(t *testing.T) {
+	a := pnew(int)
+	b := pnew([4]int)
+	s := pmake([]int, 2)
+
+	fmt.Println("Testing updates checkpointed by resumable transaction")
+	tx, err := transaction.NewResumableRedo("resume-test")
+	assertEqual(t, err, nil)
+	tx.Begin()
+	tx.Log(a, 10)
+	tx.Log3(unsafe.Pointer(b), unsafe.Sizeof(*b))
+	buf := (*[4]int)(tx.ReadLog(unsafe.Pointer(b)).(unsafe.Pointer))
+	buf[1] = 1
+	tx.End()
+	assertEqual(t, *a, 0)
+	assertEqual(t, b[1], 0)
+	assertEqual(t, tx.ReadLog(a), 10)
+
+	fmt.Println("Testing duplicate and attached resumable transactions")
+	_, err = transaction.NewResumableRedo("resume-test")
+	assertEqual(t, err != nil, true)
+	_, err = transaction.ResumeRedo("resume-test")
+	assertEqual(t, err != nil, true)
+	_, err = transaction.ResumeRedo("no-such-tx")
+	assertEqual(t, err != nil, true)
+	names := transaction.ResumableRedoNames()
+	assertEqual(t, len(names), 1)
+	assertEqual(t, names[0], "resume-test")
+
+	fmt.Println("Testing updates not checkpointed are dropped on release")
+	tx.Begin()
+	tx.Log(a, 20)
+	tx.Log(&s, []int{1, 2, 3})
+	assertEqual(t, tx.ReadLog(a), 20)
+	transaction.Release(tx)
+
+	tx, err = transaction.ResumeRedo("resume-test")
+	assertEqual(t, err, nil)
+	assertEqual(t, tx.ReadLog(a), 10)
+	assertEqual(t, tx.ReadLog(&b[1]), 1)
+	assertEqual(t, len(tx.ReadLog(&s).([]int)), 2)
+
+	fmt.Println("Testing checkpointed updates logged again after resuming")
+	tx.Begin()
+	tx.Log(a, 30)
+	tx.Log3(unsafe.Pointer(b), unsafe.Sizeof(*b))
+	buf = (*[4]int)(tx.ReadLog(unsafe.Pointer(b)).(unsafe.Pointer))
+	assertEqual(t, buf[1], 1)
+	buf[2] = 2
+	tx.Log(&s, []int{1, 2, 3})
+	tx.End()
+	assertEqual(t, tx.Begin("deferred") != nil, true)
+	assertEqual(t, tx.ReadLog(a), 30)
+	transaction.Release(tx)
+
+	fmt.Println("Testing commit of resumable transaction")
+	tx, err = transaction.ResumeRedo("resume-test")
+	assertEqual(t, err, nil)
+	tx.Begin()
+	assertEqual(t, tx.Commit() != nil, true)
+	tx.End()
+	assertEqual(t, tx.Commit(), nil)
+	assertEqual(t, *a, 30)
+	assertEqual(t, *b, [4]int{0, 1, 2, 0})
+	assertEqual(t, len(s), 3)
+	assertEqual(t, s[2], 3)
+	_, err = transaction.ResumeRedo("resume-test")
+	assertEqual(t, err != nil, true)
+	assertEqual(t, len(transaction.ResumableRedoNames()), 0)
+
+	fmt.Println("Testing discard of resumable transaction")
+	tx, err = transaction.NewResumableRedo("resume-test")
+	assertEqual(t, err, nil)
+	tx.Begin()
+	tx.Log(a, 40)
+	tx.End()
+	assertEqual(t, tx.Discard(), nil)
+	assertEqual(t, *a, 30)
+	assertEqual(t, len(transaction.ResumableRedoNames()), 0)
+
+	// The handle is usable as an ordinary redo transaction again
+	rtx := transaction.NewRedoTx()
+	rtx.Begin()
+	rtx.Log(a, 50)
+	rtx.End()
+	transaction.Release(rtx)
+	assertEqual(t, *a, 50)
+}
+
+func TestResumableRedoLocks(t *testing.T) {
+	fmt.Println("Testing resumable transaction keeps its locks across checkpoints")
+	m := new(sync.RWMutex)
+	a := pnew(int)
+	tx, err := transaction.NewResumableRedo("resume-lock-test")
+	assertEqual(t, err, nil)
+	tx.Begin()
+	tx.Lock(m)
+	tx.Log(a, 10)
+	tx.End()
+	assertEqual(t, lockedFor(m, 10*time.Millisecond), true)
+	tx.Begin()
+	tx.Log(a, 20)
+	tx.End()
+	assertEqual(t, lockedFor(m, 10*time.Millisecond), true)
+
+	fmt.Println("Testing resumable transaction releases its locks on commit")
+	assertEqual(t, tx.Commit(), nil)
+	assertEqual(t, lockedFor(m, time.Second), false)
+	assertEqual(t, *a, 20)
+
+	fmt.Println("Testing detached resumable transaction releases its locks")
+	tx, err = transaction.NewResumableRedo("resume-lock-test")
+	assertEqual(t, err, nil)
+	tx.Begin()
+	tx.Lock(m)
+	tx.Log(a, 30)
+	tx.End()
+	transaction.Release(tx)
+	assertEqual(t, lockedFor(m, time.Second), false)
+	tx, err = transaction.ResumeRedo("resume-lock-test")
+	assertEqual(t, err, nil)
+	assertEqual(t, tx.Discard(), nil)
+	assertEqual(t, *a, 20)
+}
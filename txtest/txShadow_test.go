@@ -0,0 +1,76 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type bigObj struct {
+	vals [1024]int
+	name string
+}
+
+type objHolder struct {
+	obj *bigObj
+}
+
+func TestShadowTx(t *testing.T) {
+	h := pnew(objHolder)
+	h.obj = pnew(bigObj)
+	orig := h.obj
+
+	fmt.Println("Testing shadow transaction commit")
+	tx := transaction.NewShadowTx()
+	tx.Begin()
+	assertEqual(t, tx.Log(&h.obj), nil)
+	clone := tx.ReadLog(&h.obj).(*bigObj)
+	assertEqual(t, clone != orig, true)
+	clone.vals[10] = 10
+	clone.name = "clone"
+	assertEqual(t, h.obj, orig)
+	assertEqual(t, h.obj.vals[10], 0)
+	assertEqual(t, tx.Log(&h.obj), nil) // Logging again reuses the clone
+	assertEqual(t, tx.ReadLog(&h.obj).(*bigObj), clone)
+	tx.End()
+	assertEqual(t, h.obj, clone)
+	assertEqual(t, h.obj.vals[10], 10)
+	assertEqual(t, h.obj.name, "clone")
+	assertEqual(t, orig.vals[10], 0)
+
+	fmt.Println("Testing shadow transaction abort")
+	cur := h.obj
+	tx.Begin()
+	tx.Log(&h.obj)
+	tx.ReadLog(&h.obj).(*bigObj).vals[10] = 20
+	transaction.Release(tx)
+	assertEqual(t, h.obj, cur)
+	assertEqual(t, h.obj.vals[10], 10)
+
+	fmt.Println("Testing shadow transaction with a nil object")
+	tx = transaction.NewShadowTx()
+	tx.Begin()
+	var empty *objHolder
+	h2 := pnew(objHolder)
+	assertEqual(t, tx.Log(&h2.obj) != nil, true)
+	assertEqual(t, tx.Log(h2) != nil, true)
+	assertEqual(t, tx.Log(&empty) != nil, true)
+	tx.End()
+	transaction.Release(tx)
+
+	fmt.Println("Testing shadow transaction with a parent in volatile memory")
+	vh := new(objHolder)
+	vh.obj = h.obj
+	tx = transaction.NewShadowTx()
+	tx.Begin()
+	assertEqual(t, tx.Log(&vh.obj) != nil, true)
+	tx.End()
+	transaction.Release(tx)
+	assertEqual(t, vh.obj, h.obj)
+}
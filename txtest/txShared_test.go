@@ -0,0 +1,92 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+func TestSharedTx(t *testing.T) {
+	const workers = 8
+	s := pmake([]int, workers*100)
+	a := pnew(int)
+
+	fmt.Println("Testing shared transaction updated by many goroutines")
+	tx := transaction.NewSharedTx()
+	_, err := tx.Sub()
+	assertEqual(t, err != nil, true)
+	assertEqual(t, tx.Begin("deferred") != nil, true)
+	tx.Begin()
+	tx.Log(a, 1)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		sub, err := tx.Sub()
+		assertEqual(t, err, nil)
+		wg.Add(1)
+		go func(sub transaction.TX, w int) {
+			defer wg.Done()
+			sub.Begin()
+			for i := w * 100; i < (w+1)*100; i++ {
+				sub.Log(&s[i], i)
+			}
+			sub.End()
+			// Sub-transaction handles are released with the parent
+			transaction.Release(sub)
+		}(sub, w)
+	}
+	wg.Wait()
+	assertEqual(t, s[workers*100-1], 0)
+	assertEqual(t, *a, 0)
+	assertEqual(t, tx.ReadLog(a), 1)
+	tx.End()
+	assertEqual(t, tx.Err(), nil)
+	for i := range s {
+		assertEqual(t, s[i], i)
+	}
+	assertEqual(t, *a, 1)
+
+	fmt.Println("Testing shared transaction rolled back if a sub aborts")
+	m := new(sync.RWMutex)
+	tx.Begin()
+	tx.Log(a, 2)
+	sub1, _ := tx.Sub()
+	sub2, _ := tx.Sub()
+	sub1.Begin()
+	sub1.Log(&s[0], 100)
+	sub1.End()
+	sub2.Begin()
+	sub2.Log(&s[1], 100)
+	m.Lock()
+	transaction.SetLockTimeout(10 * time.Millisecond)
+	assertEqual(t, sub2.Lock(m), transaction.ErrDeadlock)
+	transaction.SetLockTimeout(0)
+	m.Unlock()
+	tx.End()
+	assertEqual(t, tx.Err(), transaction.ErrRolledBack)
+	assertEqual(t, *a, 1)
+	assertEqual(t, s[0], 0)
+	assertEqual(t, s[1], 1)
+
+	fmt.Println("Testing release of shared transaction before it ends")
+	tx.Begin()
+	sub1, _ = tx.Sub()
+	sub1.Log(&s[0], 200)
+	transaction.Release(tx)
+	assertEqual(t, s[0], 0)
+
+	// All redo handles are available again
+	rtx := transaction.NewRedoTx()
+	rtx.Begin()
+	rtx.Log(a, 3)
+	rtx.End()
+	transaction.Release(rtx)
+	assertEqual(t, *a, 3)
+}
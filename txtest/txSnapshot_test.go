@@ -0,0 +1,79 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+///////////////////////////////////////////////////////////////////////
+
+package txtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type account struct {
+	balance1 int
+	balance2 int
+	history  [8]int
+}
+
+func TestSnapshotRead(t *testing.T) {
+	fmt.Println("Testing snapshots see all or none of a transaction's updates")
+	acct := pnew(account)
+	acct.balance1 = 100
+	transaction.RegisterVersioned(acct)
+	defer transaction.UnregisterVersioned(acct)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tx := transaction.NewRedoTx()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				transaction.Release(tx)
+				return
+			default:
+			}
+			tx.Begin()
+			tx.Log(&acct.balance1, 100-i%100)
+			for j := range acct.history {
+				tx.Log(&acct.history[j], i)
+			}
+			tx.Log(&acct.balance2, i%100)
+			tx.End()
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s := transaction.BeginSnapshot()
+				b1 := s.Read(&acct.balance1).(int)
+				h := s.Read(&acct.history).([8]int)
+				b2 := s.Read(&acct.balance2).(int)
+				s.End()
+				if b1+b2 != 100 {
+					t.Errorf("Snapshot saw balances %d and %d", b1, b2)
+					return
+				}
+				for j := range h {
+					if h[j] != h[0] {
+						t.Errorf("Snapshot saw history %v", h)
+						return
+					}
+				}
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}